@@ -1,131 +1,4409 @@
 import os
+import re
+import csv
+import codecs
 import json
+import fnmatch
+import ipaddress
+import argparse
+import pathlib
+import platform
+import subprocess
+import sys
+from datetime import date, datetime, timezone
+import urllib.error
+import urllib.parse
+import urllib.request
+import xml.etree.ElementTree as ET
+import html
+import time
+import hashlib
+import hmac
+import secrets
 import hjson
 from pyvis.network import Network
 
+__version__ = "0.1.0"
+
 # TODO: Update your company domain here
 COMPANY_DOMAIN="example.com"
 
-def load_json_or_hujson_file(filename):
+# Define colors for different node types. Presets and the "render" section
+# of --config can replace any of these.
+node_colors = {
+    'group': "#FFFF00",      # Group color (Yellow)
+    'tag': "#00cc66",        # Tag color (Green)
+    'host': "#ff6666",       # Host color (Red)
+    'ownership': "#9966cc",  # Tag ownership edge color (Purple)
+    'wildcard': "#ff9900",   # Wildcard/internet pseudo-node color (Orange)
+    'ssh': "#3366cc",        # Tailscale SSH edge color (Blue)
+    'approval': "#cc6699",   # autoApprovers edge color (Pink)
+    'derp': "#999999",       # DERP region/server color (Grey)
+    'ipset': "#66ccff",      # IP set color (Light blue)
+    'network': "#ffb3b3",    # Network (CIDR host) color (Light red)
+    'orphan': "#e0e0e0",     # Definition no rule uses (Pale grey)
+}
+
+# Hosts whose value is a CIDR or a list of ranges rather than one address,
+# filled in from the policy; they are drawn as network nodes
+network_hosts = {}
+
+# Every autogroup Tailscale defines: what it means, and where in a rule it
+# can be used ('src', 'dst' or SSH 'users')
+AUTOGROUPS = {
+    'autogroup:admin': ("Users with the Admin role", {'src'}),
+    'autogroup:network-admin': ("Users with the Network admin role", {'src'}),
+    'autogroup:it-admin': ("Users with the IT admin role", {'src'}),
+    'autogroup:billing-admin': ("Users with the Billing admin role", {'src'}),
+    'autogroup:auditor': ("Users with the Auditor role", {'src'}),
+    'autogroup:owner': ("The tailnet owner", {'src'}),
+    'autogroup:member': ("Users who are direct members of the tailnet (not invited through sharing), "
+                         "or as a destination, their devices", {'src', 'dst'}),
+    'autogroup:tagged': ("All devices with at least one tag", {'src', 'dst'}),
+    'autogroup:shared': ("Users who accepted a device shared with them", {'src'}),
+    'autogroup:self': ("Devices owned by the same user as the source, so each user only reaches their own",
+                       {'dst'}),
+    'autogroup:internet': ("Access to the internet through exit nodes", {'dst'}),
+    'autogroup:danger-all': ("Everything, including users and devices from outside the tailnet", {'src', 'dst'}),
+    'autogroup:nonroot': ("Any local user except root", {'users'}),
+}
+
+# The user role behind each role autogroup, as the users API reports it
+AUTOGROUP_USER_ROLES = {
+    'autogroup:owner': 'owner',
+    'autogroup:admin': 'admin',
+    'autogroup:network-admin': 'network-admin',
+    'autogroup:it-admin': 'it-admin',
+    'autogroup:billing-admin': 'billing-admin',
+    'autogroup:auditor': 'auditor',
+}
+
+# Targets that don't stand for a single entity, and how to label them when
+# wildcard_nodes is on
+PSEUDO_NODES = {
+    '*': ("Any (*)", "Wildcard: matches every device, user and address"),
+    'autogroup:internet': ("Internet via autogroup:internet", "Access to the internet through exit nodes"),
+}
+
+# Stands in for the exit node capability approved through autoApprovers
+EXIT_NODE = "exit node (0.0.0.0/0, ::/0)"
+
+# Rendering settings: "layout" is physics or hierarchical, "labels" is full,
+# short (type prefix stripped) or none (tooltip only). "direction" is the
+# hierarchical layout's flow (LR, RL, UD or DU) and "node_types" sets the
+# hierarchical level and physics mass of each node type.
+DEFAULT_RENDER_SETTINGS = {
+    'layout': 'physics',
+    'labels': 'full',
+    'direction': 'LR',
+    'node_types': {
+        'group': {'level': 0},
+        'tag': {'level': 1},
+        'host': {'level': 2},
+        'ipset': {'level': 2},
+        'network': {'level': 2},
+        'derp': {'level': 3},
+    },
+    'colors': {},
+    'show_tag_owners': False,
+    'show_buttons': True,
+    'wildcard_nodes': False,
+    'show_auto_approvers': True,
+    'show_derp': False,
+    'show_orphans': False,
+}
+RENDER_PRESETS = {
+    # Everything visible and laid out in layers for reviewing who can reach what
+    'audit': {
+        'layout': 'hierarchical',
+        'labels': 'full',
+        'show_tag_owners': True,
+        'show_buttons': False,
+        'wildcard_nodes': True,
+    },
+    # Uncluttered overview for slides and non-technical readers
+    'executive': {
+        'layout': 'physics',
+        'labels': 'short',
+        'colors': {'group': "#4c78a8", 'tag': "#54a24b", 'host': "#e45756"},
+        'show_tag_owners': False,
+        'show_buttons': False,
+    },
+    # Day-to-day troubleshooting with the physics controls available
+    'operations': {
+        'layout': 'physics',
+        'labels': 'full',
+        'show_tag_owners': False,
+        'show_buttons': True,
+    },
+}
+
+# IP protocols accepted in a rule's "proto", by name. A value that is a string
+# makes the name an alias for another protocol. Extended by the "protocols"
+# section of --config.
+protocols = {
+    'icmp': 1,
+    'igmp': 2,
+    'ipv4': 4,
+    'ip-in-ip': 'ipv4',
+    'tcp': 6,
+    'egp': 8,
+    'igp': 9,
+    'udp': 17,
+    'gre': 47,
+    'esp': 50,
+    'ah': 51,
+    'ipv6-icmp': 58,
+    'sctp': 132,
+}
+
+# Sentences describing each rule, shown in edge tooltips and the rules table.
+# Every template (and the names used for groups, tags and hosts) can be
+# replaced, e.g. translated, in the "summaries" section of --config.
+DEFAULT_SUMMARY_TEMPLATES = {
+    'acls': "{src} can reach {dst} on ports {ports}{posture}",
+    'grants': "{src} can reach {dst} with {ports}{posture}",
+    'ssh': "{src} can SSH to {dst} as {users}{posture}",
+    'ssh_check': "{src} can SSH to {dst} as {users} after re-authenticating{posture}",
+    'posture': " from devices matching {postures}",
+    'and': "and",
+    'names': {},
+}
+
+# Lint checks and their default severity. Findings are reported either way;
+# --fail-on decides which severity makes the run exit non-zero. Severities
+# can be changed (or a check turned "off") in the "lint" section of --config.
+LINT_CHECKS = {
+    'undefined-reference': 'warning',
+    'missing-tag-owner': 'error',
+    'host-conflict': 'warning',
+    'broad-destination': 'warning',
+    'redundant-acl': 'warning',
+    'shadowed-rule': 'warning',
+    'unreferenced-definition': 'warning',
+    # Text checks that only run with --scan
+    'unapproved-ip-range': 'warning',
+    'personal-email': 'warning',
+    'embedded-secret': 'error',
+}
+LINT_SEVERITIES = ('off', 'warning', 'error')
+
+# Grant fields the mapper understands; anything else is passed through to the
+# edge tooltip untouched
+GRANT_FIELDS = {'src', 'dst', 'ip', 'app', 'srcPosture', 'via'}
+
+# JSON Schema for the Tailscale policy file, checked by --schema-validate.
+# validate_schema() implements just the keywords used here: type, enum,
+# pattern, anyOf, required, properties, patternProperties,
+# additionalProperties, items, minItems and $ref into $defs.
+STRING_LIST_SCHEMA = {'type': 'array', 'items': {'type': 'string'}}
+NON_EMPTY_STRING_LIST_SCHEMA = {'type': 'array', 'items': {'type': 'string'}, 'minItems': 1}
+POLICY_SCHEMA = {
+    '$schema': "https://json-schema.org/draft/2020-12/schema",
+    'title': "Tailscale policy file",
+    'type': 'object',
+    'properties': {
+        'acls': {'type': 'array', 'items': {'$ref': '#/$defs/acl'}},
+        'grants': {'type': 'array', 'items': {'$ref': '#/$defs/grant'}},
+        'ssh': {'type': 'array', 'items': {'$ref': '#/$defs/ssh'}},
+        'groups': {'type': 'object', 'patternProperties': {r"^group:.": STRING_LIST_SCHEMA},
+                   'additionalProperties': False},
+        # An address, CIDR or comma-separated list of them, always as one string
+        'hosts': {'type': 'object', 'additionalProperties': {'type': 'string'}},
+        'tagOwners': {'type': 'object', 'patternProperties': {r"^tag:.": STRING_LIST_SCHEMA},
+                      'additionalProperties': False},
+        'postures': {'type': 'object', 'patternProperties': {r"^posture:.": STRING_LIST_SCHEMA},
+                     'additionalProperties': False},
+        'defaultSrcPosture': STRING_LIST_SCHEMA,
+        'ipsets': {'type': 'object', 'patternProperties': {r"^ipset:.": STRING_LIST_SCHEMA},
+                   'additionalProperties': False},
+        'autoApprovers': {
+            'type': 'object',
+            'properties': {
+                'routes': {'type': 'object', 'additionalProperties': STRING_LIST_SCHEMA},
+                'exitNode': STRING_LIST_SCHEMA,
+            },
+            'additionalProperties': False,
+        },
+        'nodeAttrs': {'type': 'array', 'items': {'$ref': '#/$defs/nodeAttr'}},
+        'tests': {'type': 'array', 'items': {'$ref': '#/$defs/test'}},
+        'sshTests': {'type': 'array', 'items': {'$ref': '#/$defs/sshTest'}},
+        'derpMap': {'type': 'object'},
+        'disableIPv4': {'type': 'boolean'},
+        'OneCSNATRoute': {'type': 'boolean'},
+        'randomizeClientPort': {'type': 'boolean'},
+    },
+    'additionalProperties': False,
+    '$defs': {
+        # The legacy "users" and "ports" spellings of src and dst aren't
+        # mapped, so they are reported as unknown properties
+        'acl': {
+            'type': 'object',
+            'properties': {
+                'action': {'enum': ['accept']},
+                'src': NON_EMPTY_STRING_LIST_SCHEMA,
+                # Every destination needs a port, e.g. "tag:web:443" or "*:*"
+                'dst': {'type': 'array', 'items': {'type': 'string', 'pattern': r":[\d,*-]+$"}, 'minItems': 1},
+                'proto': {'anyOf': [{'type': 'string'}, STRING_LIST_SCHEMA]},
+                'srcPosture': STRING_LIST_SCHEMA,
+            },
+            'required': ['action', 'src', 'dst'],
+            'additionalProperties': False,
+        },
+        'grant': {
+            'type': 'object',
+            'properties': {
+                'src': NON_EMPTY_STRING_LIST_SCHEMA,
+                'dst': NON_EMPTY_STRING_LIST_SCHEMA,
+                # "443", "tcp:443", "6:80-90" or "*"
+                'ip': {'type': 'array', 'items': {'type': 'string', 'pattern': r"^(?:[\w-]+:)?[\d,*-]+$"}},
+                'app': {'type': 'object'},
+                'srcPosture': STRING_LIST_SCHEMA,
+                'via': STRING_LIST_SCHEMA,
+            },
+            'required': ['src', 'dst'],
+            'anyOf': [{'required': ['ip']}, {'required': ['app']}],
+            'description': "a grant needs an ip list or an app object",
+            # Grants keep gaining fields, and the mapper shows the ones it
+            # doesn't know (see GRANT_FIELDS) rather than rejecting them
+            'additionalProperties': True,
+        },
+        'ssh': {
+            'type': 'object',
+            'properties': {
+                'action': {'enum': ['accept', 'check']},
+                'src': NON_EMPTY_STRING_LIST_SCHEMA,
+                'dst': NON_EMPTY_STRING_LIST_SCHEMA,
+                'users': NON_EMPTY_STRING_LIST_SCHEMA,
+                'checkPeriod': {'type': 'string'},
+                'acceptEnv': STRING_LIST_SCHEMA,
+                'srcPosture': STRING_LIST_SCHEMA,
+            },
+            'required': ['action', 'src', 'dst', 'users'],
+            'additionalProperties': False,
+        },
+        'nodeAttr': {
+            'type': 'object',
+            'properties': {
+                'target': NON_EMPTY_STRING_LIST_SCHEMA,
+                'attr': STRING_LIST_SCHEMA,
+                'app': {'type': 'object'},
+            },
+            'required': ['target'],
+            'anyOf': [{'required': ['attr']}, {'required': ['app']}],
+            'description': "a nodeAttrs entry needs an attr list or an app object",
+            'additionalProperties': False,
+        },
+        'test': {
+            'type': 'object',
+            'properties': {
+                'src': {'type': 'string'},
+                'srcPostureAttrs': {'type': 'object'},
+                'proto': {'type': 'string'},
+                'accept': STRING_LIST_SCHEMA,
+                'deny': STRING_LIST_SCHEMA,
+            },
+            'required': ['src'],
+            'additionalProperties': False,
+        },
+        'sshTest': {
+            'type': 'object',
+            'properties': {
+                'src': {'type': 'string'},
+                'dst': STRING_LIST_SCHEMA,
+                'accept': STRING_LIST_SCHEMA,
+                'check': STRING_LIST_SCHEMA,
+                'deny': STRING_LIST_SCHEMA,
+            },
+            'required': ['src', 'dst'],
+            'additionalProperties': False,
+        },
+    },
+}
+JSON_SCHEMA_TYPES = {
+    'object': lambda value: isinstance(value, dict),
+    'array': lambda value: isinstance(value, list),
+    'string': lambda value: isinstance(value, str),
+    'boolean': lambda value: isinstance(value, bool),
+    'integer': lambda value: isinstance(value, int) and not isinstance(value, bool),
+    'number': lambda value: isinstance(value, (int, float)) and not isinstance(value, bool),
+}
+
+# How each kind of expectation in the policy's tests/sshTests reads in results
+TEST_EXPECTATIONS = {'accept': "allowed", 'check': "allowed in check mode", 'deny': "denied"}
+
+# First line of the example policy.hujson shipped with the repo (and Docker image)
+SAMPLE_POLICY_MARKER = "// THIS IS AN EXAMPLE POLICY FILE"
+
+# Defaults for --scan, each of which can be overridden in the "scan" section of --config
+DEFAULT_APPROVED_IP_RANGES = [
+    "100.64.0.0/10",   # Tailscale CGNAT range
+    "10.0.0.0/8",
+    "172.16.0.0/12",
+    "192.168.0.0/16",
+    "fd7a:115c:a1e0::/48",  # Tailscale IPv6 range
+]
+DEFAULT_PERSONAL_EMAIL_DOMAINS = [
+    "gmail.com", "googlemail.com", "yahoo.com", "hotmail.com", "outlook.com",
+    "live.com", "icloud.com", "me.com", "aol.com", "proton.me", "protonmail.com",
+]
+DEFAULT_SECRET_PATTERNS = {
+    "tailscale-key": r"tskey-[A-Za-z0-9-]+",
+    "aws-access-key": r"AKIA[0-9A-Z]{16}",
+    "github-token": r"gh[pousr]_[A-Za-z0-9]{36}",
+    "private-key": r"-----BEGIN [A-Z ]*PRIVATE KEY-----",
+    "credential-assignment": r"(?i)\b(api[_-]?key|secret|token|password)\s*[:=]\s*\S+",
+}
+
+IPV4_PATTERN = re.compile(r"\b\d{1,3}(?:\.\d{1,3}){3}(?:/\d{1,2})?\b")
+# Loose on purpose; candidates are checked with ipaddress before use
+IPV6_PATTERN = re.compile(r"(?<![\w:])[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}(?:/\d{1,3})?(?![\w:])")
+IPSET_OPERATION_PATTERN = re.compile(r"^(add|remove)\s+")
+COLLECTION_ANNOTATION_PATTERN = re.compile(r"//\s*collection:\s*(.+?)\s*$")
+EXPIRY_ANNOTATION_PATTERN = re.compile(r"//\s*expires:\s*(\S+)")
+POSTURE_EXPRESSION_PATTERN = re.compile(
+    r"^\s*(?P<attribute>[A-Za-z][\w-]*:[\w.-]+)\s*(?P<operator>IS SET|NOT SET|NOT IN|IN|==|!=|<=|>=|<|>)\s*(?P<value>.*?)\s*$")
+VARIABLE_PATTERN = re.compile(r"\$\{([A-Za-z_][A-Za-z0-9_]*)\}")
+EMAIL_PATTERN = re.compile(r"[A-Za-z0-9._%+-]+@([A-Za-z0-9.-]+\.[A-Za-z]{2,})")
+# Tailscale logins include ones without a TLD, like alice@github
+USER_LOGIN_PATTERN = re.compile(r"[\w.%+-]+@[\w-]+(?:\.[\w-]+)*")
+FQDN_PATTERN = re.compile(r"[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z][A-Za-z0-9-]*")
+
+# The rule lists that "// collection:" and "// expires:" comments can mark,
+# and what their rules are called in messages
+ANNOTATED_SECTIONS = {'acls': "ACL rule", 'grants': "Grant", 'ssh': "SSH rule"}
+
+# Environment variables that set flags (TSMAP_OUTPUT_DIR) and config keys
+# (TSMAP_CONFIG__RENDER__LAYOUT) start with this
+ENV_PREFIX = "TSMAP_"
+
+# Flags that can be set through the environment, and how their value is
+# read: 'switch' (1/true/yes/on), 'value' or 'list' (comma-separated). Flags
+# that do one thing and exit (--inventory, --run-tests, ...) are left out so
+# a stray variable can't take over every run.
+ENV_OPTIONS = {
+    '--policy': 'list',
+    '--tailnet': 'value',
+    '--devices': 'value',
+    '--config': 'value',
+    '--scan': 'switch',
+    '--output-dir': 'value',
+    '--schema-validate': 'switch',
+    '--lenient': 'switch',
+    '--strict-variables': 'switch',
+    '--include': 'list',
+    '--exclude': 'list',
+    '--redact': 'list',
+    '--focus': 'value',
+    '--depth': 'value',
+    '--wildcard-nodes': 'switch',
+    '--export-drawio': 'value',
+    '--badges': 'switch',
+    '--audit-log': 'value',
+    '--preset': 'value',
+    '--show-tag-owners': 'switch',
+    '--show-derp': 'switch',
+    '--show-orphans': 'switch',
+    '--anonymize': 'switch',
+    '--export-group-members': 'value',
+    '--evaluate-postures': 'value',
+    '--fail-on': 'value',
+}
+
+# Environment variables starting with this fill ${VAR} placeholders:
+# POLICY_VAR_DB_IP=100.64.0.10 for ${DB_IP}. Nothing else in the environment
+# is substituted unless the config lists it under "variables_from_env".
+POLICY_VARIABLE_PREFIX = "POLICY_VAR_"
+
+# Policies fetched from here are authenticated with TAILSCALE_API_KEY or an
+# OAuth client (TAILSCALE_OAUTH_CLIENT_ID/TAILSCALE_OAUTH_CLIENT_SECRET)
+TAILSCALE_API_URL = "https://api.tailscale.com/api/v2"
+
+# How a policy piped in with --policy - is named in messages and tooltips
+STDIN_SOURCE = "<stdin>"
+
+# Warnings raised during this run, kept for the audit log
+run_warnings = []
+
+# (scheme, host, port) of the https policy URLs given with --policy; only
+# these get POLICY_AUTH_HEADER and the policy_url headers from --config
+credential_origins = set()
+
+# (commit, build date) of the running script, looked up by get_build_info
+build_info = None
+
+# find_value_positions and find_rule_lines results by policy text (and
+# section), so locating every rule doesn't tokenize the whole file again
+value_positions_cache = {}
+rule_lines_cache = {}
+
+
+def warn(message):
+    print(f"Warning: {message}")
+    run_warnings.append(message)
+
+
+def load_json_or_hujson_file(filename):
+    if not os.path.isfile(filename):
+        print(f"Error: File '{filename}' not found.")
+        return None
+
+    with open(filename, 'rb') as f:
+        return load_json_or_hujson_text(decode_policy_bytes(f.read(), filename), filename)
+
+
+def decode_policy_bytes(data, name):
+    # Files saved by Windows editors often carry a BOM, are UTF-16, or use
+    # CRLF line endings. Decode them all to plain text with \n line endings so
+    # the parsers and line numbers behave the same as for UTF-8 files.
+    for bom, encoding in ((codecs.BOM_UTF32_LE, 'utf-32-le'), (codecs.BOM_UTF32_BE, 'utf-32-be'),
+                          (codecs.BOM_UTF8, 'utf-8'), (codecs.BOM_UTF16_LE, 'utf-16-le'),
+                          (codecs.BOM_UTF16_BE, 'utf-16-be')):
+        if data.startswith(bom):
+            data = data[len(bom):]
+            break
+    else:
+        # UTF-16 without a BOM: every other byte of the ASCII-heavy JSON is NUL
+        sample = data[:200]
+        if len(sample) >= 2 and sample[1::2].count(0) > len(sample) // 4:
+            encoding = 'utf-16-le'
+        elif len(sample) >= 2 and sample[0::2].count(0) > len(sample) // 4:
+            encoding = 'utf-16-be'
+        else:
+            encoding = 'utf-8'
+    try:
+        text = data.decode(encoding)
+    except UnicodeDecodeError:
+        warn(f"'{name}' is not valid {encoding}; decoding it as latin-1")
+        text = data.decode('latin-1')
+    return text.replace('\r\n', '\n').replace('\r', '\n')
+
+
+def load_json_or_hujson_text(text, name):
+    # Try loading as JSON
+    try:
+        data = json.loads(text)
+        return data
+    except ValueError:
+        # If loading as JSON fails, try loading as HuJSON
+        try:
+            data = hjson.loads(text)
+            return data
+        except Exception as e:
+            lineno = getattr(e, 'lineno', None)
+            colno = getattr(e, 'colno', None)
+            if lineno is None or colno is None:
+                print(f"Error decoding '{name}' as HuJSON: {e}")
+            else:
+                print(f"Error decoding '{name}' as HuJSON: {getattr(e, 'msg', e)} (line {lineno}, column {colno})")
+                print(format_error_snippet(text, lineno, colno))
+            return None
+
+
+def format_error_snippet(text, lineno, colno, context=2):
+    # A few numbered lines leading up to the error with a caret under the
+    # offending column
+    lines = text.split('\n')
+    first = max(1, lineno - context)
+    width = len(str(lineno))
+    snippet = []
+    for number in range(first, min(lineno, len(lines)) + 1):
+        snippet.append(f"  {number:>{width}} | {lines[number - 1]}")
+    if 1 <= lineno <= len(lines):
+        # Keep tabs so the caret lines up with tab-indented policies
+        prefix = ''.join(c if c == '\t' else ' ' for c in lines[lineno - 1][:colno - 1])
+        snippet.append(f"  {' ' * width} | {prefix}^")
+    return '\n'.join(snippet)
+
+
+def is_url(source):
+    return source.startswith(('https://', 'http://'))
+
+
+def get_url_origin(url):
+    parts = urllib.parse.urlsplit(url)
+    return parts.scheme.lower(), (parts.hostname or '').lower(), parts.port or {'https': 443, 'http': 80}.get(parts.scheme)
+
+
+def get_tailscale_api_token(url_config):
+    # An API access token, or an OAuth client's credentials exchanged for a
+    # short-lived one
+    if os.environ.get('TAILSCALE_API_KEY'):
+        return os.environ['TAILSCALE_API_KEY']
+    client_id = os.environ.get('TAILSCALE_OAUTH_CLIENT_ID')
+    client_secret = os.environ.get('TAILSCALE_OAUTH_CLIENT_SECRET')
+    if not client_id or not client_secret:
+        print("Error: Set TAILSCALE_API_KEY, or TAILSCALE_OAUTH_CLIENT_ID and TAILSCALE_OAUTH_CLIENT_SECRET, "
+              "to read the policy from the Tailscale API")
+        return None
+    data = urllib.parse.urlencode({'client_id': client_id, 'client_secret': client_secret,
+                                   'grant_type': 'client_credentials'}).encode()
+    try:
+        with urllib.request.urlopen(f"{TAILSCALE_API_URL}/oauth/token", data=data,
+                                    timeout=url_config.get('timeout', 30)) as response:
+            return json.loads(response.read())['access_token']
+    except (urllib.error.URLError, OSError, ValueError, KeyError) as e:
+        print(f"Error getting a Tailscale API access token for the OAuth client: {e}")
+        return None
+
+
+def get_tailnet_api_url(tailnet, endpoint):
+    # "-" is the tailnet the API key or OAuth client belongs to
+    return f"{TAILSCALE_API_URL}/tailnet/{urllib.parse.quote(tailnet, safe='')}/{endpoint}"
+
+
+def fetch_policy_url(url, url_config):
+    # Headers come from the "policy_url" section of --config; POLICY_AUTH_HEADER
+    # keeps a token out of the config file. They are only sent over https to
+    # the server the policy itself came from, never to imports or fragments
+    # hosted elsewhere.
+    headers = dict(url_config.get('headers', {}))
+    if os.environ.get('POLICY_AUTH_HEADER'):
+        headers['Authorization'] = os.environ['POLICY_AUTH_HEADER']
+    if headers and not (url.startswith('https://') and get_url_origin(url) in credential_origins):
+        if not url.startswith(TAILSCALE_API_URL + '/'):
+            warn(f"Not sending the policy_url headers or POLICY_AUTH_HEADER to '{url}'; they only go to https URLs "
+                 f"on the same server as --policy")
+        headers = {}
+    # The cache is kept per credential as well as per URL: "-" names a
+    # different tailnet for every API key, and a server may serve each token
+    # its own policy. OAuth access tokens change on every run, so the client
+    # ID stands in for them.
+    identity = json.dumps(sorted(headers.items()))
+    if url.startswith(TAILSCALE_API_URL + '/'):
+        identity = os.environ.get('TAILSCALE_API_KEY') or os.environ.get('TAILSCALE_OAUTH_CLIENT_ID', '')
+        # Only the Tailscale API gets the Tailscale credentials. Asking for
+        # HuJSON keeps the comments, so annotations and line numbers work.
+        token = get_tailscale_api_token(url_config)
+        if token is None:
+            return None
+        headers['Authorization'] = f"Bearer {token}"
+        if url.endswith('/acl'):
+            headers['Accept'] = 'application/hujson'
+    cache_paths = get_policy_cache_paths(url, identity, url_config)
+    cached = read_policy_cache(cache_paths)
+    if cached:
+        # Conditional request: the server answers 304 if the copy is current
+        if cached[0].get('etag'):
+            headers['If-None-Match'] = cached[0]['etag']
+        if cached[0].get('last_modified'):
+            headers['If-Modified-Since'] = cached[0]['last_modified']
+    request = urllib.request.Request(url, headers=headers)
+    try:
+        with urllib.request.urlopen(request, timeout=url_config.get('timeout', 30)) as response:
+            data = response.read()
+            write_policy_cache(cache_paths, url, response.headers, data)
+            return decode_policy_bytes(data, url)
+    except urllib.error.HTTPError as e:
+        if e.code == 304 and cached:
+            return decode_policy_bytes(cached[1], url)
+        # Client errors (bad token, wrong URL) are real problems, the rest
+        # may be a blip on the server's side
+        if cached and (e.code >= 500 or e.code == 429):
+            return use_cached_policy(url, cached, e)
+        print(f"Error fetching policy from '{url}': {e}")
+        return None
+    except (urllib.error.URLError, OSError) as e:
+        if cached:
+            return use_cached_policy(url, cached, e)
+        print(f"Error fetching policy from '{url}': {e}")
+        return None
+
+
+def get_policy_cache_paths(url, identity, url_config):
+    # The last good copy of every fetched URL is kept under "cache_dir" in the
+    # "policy_url" section of --config; "cache": false turns caching off.
+    # identity is whatever tells the credentials apart; only its hash ends up
+    # in the file name.
+    if not url_config.get('cache', True):
+        return None
+    cache_dir = url_config.get('cache_dir') or os.path.join(
+        os.environ.get('XDG_CACHE_HOME') or os.path.expanduser('~/.cache'), 'tailscale-network-topology-mapper')
+    key = hashlib.sha256(f"{identity}\0{url}".encode()).hexdigest()[:32]
+    return os.path.join(cache_dir, f"{key}.body"), os.path.join(cache_dir, f"{key}.json")
+
+
+def read_policy_cache(cache_paths):
+    # (metadata, body) of the cached copy, or None
+    if cache_paths is None:
+        return None
+    try:
+        with open(cache_paths[1], 'r') as f:
+            metadata = json.load(f)
+        with open(cache_paths[0], 'rb') as f:
+            return metadata, f.read()
+    except (OSError, ValueError):
+        return None
+
+
+def write_policy_cache(cache_paths, url, response_headers, data):
+    if cache_paths is None:
+        return
+    metadata = {
+        'url': url,
+        'etag': response_headers.get('ETag'),
+        'last_modified': response_headers.get('Last-Modified'),
+        'fetched_at': datetime.now(timezone.utc).isoformat(),
+    }
+    try:
+        os.makedirs(os.path.dirname(cache_paths[0]), exist_ok=True)
+        # Written to a temporary file first so a crash never leaves half a policy
+        for path, content, mode in ((cache_paths[0], data, 'wb'), (cache_paths[1], json.dumps(metadata), 'w')):
+            with open(path + '.tmp', mode) as f:
+                f.write(content)
+            os.replace(path + '.tmp', path)
+    except OSError as e:
+        warn(f"Could not cache the policy from '{url}': {e}")
+
+
+def use_cached_policy(url, cached, error):
+    warn(f"Could not fetch '{url}' ({error}); using the copy cached at {cached[0].get('fetched_at', 'an unknown time')}")
+    return decode_policy_bytes(cached[1], url)
+
+
+def read_policy_text(source, config):
+    if source == STDIN_SOURCE:
+        return decode_policy_bytes(sys.stdin.buffer.read(), source)
+    if is_url(source):
+        return fetch_policy_url(source, config.get('policy_url', {}))
+    if not os.path.isfile(source):
+        print(f"Error: File '{source}' not found.")
+        return None
+    with open(source, 'rb') as f:
+        return decode_policy_bytes(f.read(), source)
+
+
+def get_build_info():
+    # The commit and its date when running from a git checkout, otherwise the
+    # date the script was installed. Looked up once, and only when shown.
+    global build_info
+    if build_info is None:
+        script_dir = os.path.dirname(os.path.abspath(__file__))
+        try:
+            result = subprocess.run(['git', 'log', '-1', '--format=%h %cs'], capture_output=True, text=True,
+                                    cwd=script_dir)
+        except OSError:
+            result = None
+        if result is not None and result.returncode == 0 and len(result.stdout.split()) == 2:
+            build_info = tuple(result.stdout.split())
+        else:
+            built = date.fromtimestamp(os.path.getmtime(os.path.abspath(__file__))).isoformat()
+            build_info = ("unknown", built)
+    return build_info
+
+
+def get_version_string(prog):
+    commit, built = get_build_info()
+    return f"{prog} {__version__} (commit {commit}, built {built}, Python {platform.python_version()})"
+
+
+def parse_args(argv=None, environ=os.environ):
+    parser = argparse.ArgumentParser(description="Generate a network map from a Tailscale ACL policy file.")
+    parser.add_argument('--version', action='store_true',
+                        help="Show the mapper version, git commit, build date and Python version, then exit")
+    parser.add_argument('--policy', metavar='FILE', action='append',
+                        help="ACL policy file, directory of policy fragments, http(s) URL or - for stdin to map "
+                             "(default: $POLICY_FILE, or policy.hujson). Can be repeated to merge several files.")
+    parser.add_argument('--tailnet', metavar='TAILNET',
+                        help="Map the policy currently deployed to TAILNET, read from the Tailscale API instead of a "
+                             "file ('-' for the tailnet of the API key or OAuth client)")
+    parser.add_argument('--devices', metavar='SOURCE',
+                        help="Compare the policy with the devices in the tailnet and show the differences (drift). "
+                             "SOURCE is the JSON from the Tailscale API's device list (/devices?fields=all) as a file "
+                             "or URL, or 'api' to fetch it for --tailnet")
+    parser.add_argument('--config', metavar='FILE',
+                        help="JSON/HuJSON file with settings for the mapper")
+    parser.add_argument('--scan', action='store_true',
+                        help="Also scan the policy text (including comments) for unapproved IP ranges, personal email "
+                             "addresses and embedded secrets, reported as lint checks")
+    parser.add_argument('--output-dir', metavar='DIR', default='.',
+                        help="Directory to write network_topology.html to, created if it doesn't exist (default: current directory)")
+    parser.add_argument('--schema-validate', action='store_true',
+                        help="Also check the policy against the built-in JSON Schema of the policy format, reporting "
+                             "problems by path (e.g. /grants/3/ip/0)")
+    parser.add_argument('--lenient', action='store_true',
+                        help="Skip invalid rules (listed in the output and a banner on the map) instead of stopping")
+    parser.add_argument('--strict-variables', action='store_true',
+                        help="Treat ${VAR} placeholders in the policy that have no value as errors instead of warnings")
+    parser.add_argument('--include', metavar='PATTERN', action='append', default=[],
+                        help="Only render edges touching a node matching PATTERN (e.g. 'tag:prod*'); can be repeated")
+    parser.add_argument('--exclude', metavar='PATTERN', action='append', default=[],
+                        help="Leave out nodes matching PATTERN (e.g. 'autogroup:*') and their edges; can be repeated")
+    parser.add_argument('--redact', metavar='PATTERN', action='append', default=[],
+                        help="Show nodes matching PATTERN (e.g. 'tag:secrets-*') under a placeholder name with an empty "
+                             "tooltip, keeping their edges; can be repeated")
+    parser.add_argument('--focus', metavar='NODE',
+                        help="Only render NODE and what is within --depth hops of it")
+    parser.add_argument('--depth', type=int, default=1,
+                        help="Number of hops around the --focus node to include (default: 1)")
+    parser.add_argument('--wildcard-nodes', action='store_true',
+                        help="Draw '*' and autogroup:internet as labelled pseudo-nodes so wildcard exposure stands out")
+    parser.add_argument('--export-drawio', metavar='FILE',
+                        help="Also write the graph as a draw.io diagram to FILE for hand editing")
+    parser.add_argument('--badges', action='store_true',
+                        help="Also write shields.io-style SVG badges (rule count, lint result, last update) to "
+                             "the badges directory under --output-dir")
+    parser.add_argument('--audit-log', metavar='FILE',
+                        help="Append a JSON Lines record of this run (policy hash, stats, warnings, duration, outputs) to FILE")
+    parser.add_argument('--preset', choices=sorted(RENDER_PRESETS),
+                        help="Use a bundle of rendering settings (layout, labels, colors and layers) suited to the audience")
+    parser.add_argument('--show-tag-owners', action='store_true',
+                        help="Draw dashed edges from each tag to the users/groups allowed to apply it (from tagOwners)")
+    parser.add_argument('--show-derp', action='store_true',
+                        help="Draw the custom DERP regions and relay servers from the policy's derpMap")
+    parser.add_argument('--show-orphans', action='store_true',
+                        help="Draw groups, hosts and tags that no rule uses as dimmed nodes")
+    parser.add_argument('--anonymize', action='store_true',
+                        help="Replace emails, host names and IP addresses with consistent pseudonyms in every output, "
+                             "for sharing the map outside the organization")
+    parser.add_argument('--export-group-members', metavar='FILE',
+                        help="Write the expanded member list of every group to FILE (.csv or .json) instead of rendering the map. "
+                             "With --tailnet (or --devices api), autogroup: members are expanded through the API. "
+                             "If FILE already exists, the changes since that export are printed first.")
+    parser.add_argument('--evaluate-postures', metavar='FILE',
+                        help="Check which postures each device in FILE (JSON/HuJSON of device -> {attribute: value}) "
+                             "satisfies, then exit")
+    parser.add_argument('--remove-redundant-acls', metavar='FILE',
+                        help="Write the policy to FILE without the ACL rules that grants already cover, then exit")
+    parser.add_argument('--convert-to-grants', metavar='FILE',
+                        help="Write the ACL rules rewritten as equivalent grants to FILE (HuJSON), with comments "
+                             "on the ones that need a closer look, then exit")
+    parser.add_argument('--inventory', metavar='FILE',
+                        help="Map every tailnet listed in FILE (JSON/HuJSON) into its own subdirectory of --output-dir "
+                             "and write a roll-up scorecard (inventory.html, inventory.csv), then exit")
+    parser.add_argument('--fail-on', choices=['warning', 'error'],
+                        help="Exit non-zero (after writing the map) if a lint check finds something of this severity "
+                             "or worse")
+    parser.add_argument('--run-tests', action='store_true',
+                        help="Run the policy's tests and sshTests against its rules, print every result and exit "
+                             "(non-zero if any fail)")
+    parser.add_argument('--remove-rule', metavar='RULE', type=parse_rule_spec,
+                        help="Show what access would disappear if an ACL rule were removed, then exit. "
+                             "RULE is the rule's index in the acls list (starting at 0) or line:N for the rule at line N.")
+    env_defaults = get_env_flag_defaults(parser, environ)
+    # argparse appends to a list default instead of replacing it, so a list
+    # from the environment is only filled in when the flag isn't given at all
+    env_lists = {dest: env_defaults.pop(dest) for dest in list(env_defaults)
+                 if ENV_OPTIONS['--' + dest.replace('_', '-')] == 'list'}
+    parser.set_defaults(**env_defaults, **{dest: None for dest in env_lists})
+    args = parser.parse_args(argv)
+    for dest, value in env_lists.items():
+        if getattr(args, dest) is None:
+            setattr(args, dest, value)
+    if args.version:
+        print(get_version_string(parser.prog))
+        sys.exit(0)
+    return args
+
+
+def get_env_flag_defaults(parser, environ):
+    # The flags in ENV_OPTIONS can also be set through the environment,
+    # --output-dir as TSMAP_OUTPUT_DIR and so on. Values go through the parser
+    # itself so types and choices are checked the same way. Flags given on
+    # the command line still win.
+    defaults = {}
+    for option, kind in ENV_OPTIONS.items():
+        dest = option[2:].replace('-', '_')
+        name = ENV_PREFIX + dest.upper()
+        if name not in environ:
+            continue
+        value = environ[name]
+        if kind == 'switch':
+            defaults[dest] = value.strip().lower() in ('1', 'true', 'yes', 'on')
+            continue
+        if kind == 'list':
+            argv = [f"{option}={item.strip()}" for item in value.split(',') if item.strip()]
+        else:
+            argv = [f"{option}={value}"]
+        try:
+            parsed = parser.parse_args(argv)
+        except SystemExit:
+            print(f"(set by the {name} environment variable)", file=sys.stderr)
+            raise
+        defaults[dest] = getattr(parsed, dest)
+    return defaults
+
+
+def apply_env_config(config, environ):
+    # TSMAP_CONFIG__RENDER__LAYOUT=hierarchical sets config["render"]["layout"].
+    # Values are parsed as JSON when they can be, so lists, numbers, booleans
+    # and whole sections work too; anything else is taken as a plain string.
+    prefix = ENV_PREFIX + 'CONFIG__'
+    for name in sorted(environ):
+        if not name.startswith(prefix) or len(name) == len(prefix):
+            continue
+        try:
+            value = json.loads(environ[name])
+        except ValueError:
+            value = environ[name]
+        keys = name[len(prefix):].lower().split('__')
+        section = config
+        for key in keys[:-1]:
+            if not isinstance(section.get(key), dict):
+                section[key] = {}
+            section = section[key]
+        section[keys[-1]] = value
+    return config
+
+
+def resolve_import_path(importer, imported):
+    # Imports are relative to the file (or URL) that lists them
+    if is_url(imported) or os.path.isabs(imported):
+        return imported
+    if is_url(importer):
+        return urllib.parse.urljoin(importer, imported)
+    return os.path.normpath(os.path.join(os.path.dirname(importer), imported))
+
+
+def get_policy_variables(config, environ):
+    # The config's "variables", then POLICY_VAR_* and the environment
+    # variables the config allows by name, which take precedence
+    variables = dict(config.get('variables', {}))
+    for name in config.get('variables_from_env', []):
+        if name in environ:
+            variables[name] = environ[name]
+    for name, value in environ.items():
+        if name.startswith(POLICY_VARIABLE_PREFIX) and len(name) > len(POLICY_VARIABLE_PREFIX):
+            variables[name[len(POLICY_VARIABLE_PREFIX):]] = value
+    return variables
+
+
+def substitute_variables(text, variables):
+    # Replaces ${VAR} placeholders, leaving unknown ones in place. Values are
+    # JSON-escaped so they can't end the string they sit in, and substituted
+    # into the raw text so line numbers are unchanged.
+    unresolved = []
+
+    def replace(match):
+        name = match.group(1)
+        if name in variables:
+            return json.dumps(str(variables[name]))[1:-1]
+        unresolved.append((name, text.count('\n', 0, match.start()) + 1))
+        return match.group(0)
+
+    return VARIABLE_PATTERN.sub(replace, text), unresolved
+
+
+def load_policy(source, text, config, chain=()):
+    # Parses a policy and everything it pulls in through "imports". Returns the
+    # merged policy, the text of every file read (for line lookups and scans)
+    # and the provenance of each definition and rule, or None on any error.
+    # Placeholders in remote policies are left alone: whoever serves them
+    # shouldn't be able to read local variables back out of the map.
+    if is_url(source):
+        if VARIABLE_PATTERN.search(text):
+            warn(f"{source}: ${{VAR}} placeholders are not substituted in remote policies")
+        unresolved = []
+    else:
+        text, unresolved = substitute_variables(text, get_policy_variables(config, os.environ))
+    for name, line in unresolved:
+        message = (f"{source}:{line}: ${{{name}}} is not set in the config variables or "
+                   f"${POLICY_VARIABLE_PREFIX}{name}")
+        if config.get('strict_variables'):
+            print(f"Error: {message}")
+        else:
+            warn(message)
+    if unresolved and config.get('strict_variables'):
+        return None
+
+    duplicates = find_duplicate_keys(text)
+    for path, key, first_line, line in duplicates:
+        where = f" in '{path}'" if path else ""
+        print(f"Error: {source}:{line}: duplicate key '{key}'{where} (first defined at line {first_line})")
+    if duplicates:
+        return None
+
+    policy = load_json_or_hujson_text(text, source)
+    if policy is None:
+        return None
+    chain = chain + (source,)
+    sources = {source: text}
+    provenance = {}
+    for section, value in policy.items():
+        if isinstance(value, dict):
+            provenance[section] = {key: source for key in value}
+        elif isinstance(value, list):
+            provenance[section] = [(source, position) for position in range(len(value))]
+
+    for imported in policy.pop('imports', []):
+        path = resolve_import_path(source, imported)
+        if path in chain:
+            print(f"Error: Import cycle: {' -> '.join(chain + (path,))}")
+            return None
+        imported_text = read_policy_text(path, config)
+        if imported_text is None:
+            print(f"Error: Could not read '{imported}' imported by '{source}'")
+            return None
+        loaded = load_policy(path, imported_text, config, chain)
+        if loaded is None:
+            return None
+        fragment, fragment_sources, fragment_provenance = loaded
+        sources.update(fragment_sources)
+        merge_policy_fragment(policy, provenance, fragment, fragment_provenance)
+    return policy, sources, provenance
+
+
+def expand_policy_paths(paths):
+    # A directory stands for the .json/.hujson files in it, in name order, so
+    # the merge is the same on every machine
+    expanded = []
+    for path in paths:
+        if path == '-':
+            expanded.append(STDIN_SOURCE)
+        elif not is_url(path) and os.path.isdir(path):
+            expanded += sorted(os.path.join(path, name) for name in os.listdir(path)
+                               if name.endswith(('.json', '.hujson')))
+        else:
+            expanded.append(path)
+    return expanded
+
+
+def load_policy_files(paths, config):
+    # Loads every file (with its imports) and merges them in order, as if the
+    # first file imported the rest: rules are appended and the earlier file
+    # wins on conflicting definitions
+    merged = None
+    for path in paths:
+        if not is_url(path) and path != STDIN_SOURCE:
+            check_policy_source(path)
+        text = read_policy_text(path, config)
+        if text is None:
+            print(f"Error: Could not read policy file '{path}'")
+            return None
+        loaded = load_policy(path, text, config)
+        if loaded is None:
+            return None
+        if merged is None:
+            merged = loaded
+        else:
+            policy, sources, provenance = merged
+            sources.update(loaded[1])
+            merge_policy_fragment(policy, provenance, loaded[0], loaded[2])
+    return merged
+
+
+def merge_policy_fragment(policy, provenance, fragment, fragment_provenance):
+    # The importing (or earlier) file wins on conflicting definitions; rule
+    # lists are appended after its own rules so their indexes don't shift.
+    for section, value in fragment.items():
+        if section not in policy:
+            policy[section] = value
+            provenance[section] = fragment_provenance.get(section)
+        elif isinstance(value, dict) and isinstance(policy[section], dict):
+            for key, item in value.items():
+                origin = fragment_provenance[section][key]
+                if key not in policy[section]:
+                    policy[section][key] = item
+                    provenance[section][key] = origin
+                elif policy[section][key] != item:
+                    warn(f"'{key}' in '{section}' is defined in both '{provenance[section][key]}' and "
+                         f"'{origin}'; using the definition from '{provenance[section][key]}'")
+        elif isinstance(value, list) and isinstance(policy[section], list):
+            policy[section].extend(value)
+            provenance[section].extend(fragment_provenance[section])
+        elif policy[section] != value:
+            warn(f"'{section}' is set in more than one policy file; ignoring the value from the later file")
+
+
+def running_in_container():
+    if os.path.exists('/.dockerenv'):
+        return True
+    try:
+        with open('/proc/1/cgroup', 'r') as f:
+            cgroup = f.read()
+    except OSError:
+        return False
+    return any(marker in cgroup for marker in ('docker', 'kubepods', 'containerd', 'podman'))
+
+
+def is_mounted_path(path):
+    # A file bind-mounted on its own, or inside a mounted directory (the usual
+    # "-v $PWD:/data"), is under some mount point other than the image's "/".
+    # mountinfo escapes spaces and the like as octal, e.g. "\040".
+    path = os.path.realpath(path)
+    try:
+        with open('/proc/self/mountinfo', 'r') as f:
+            mount_points = [re.sub(r"\\([0-7]{3})", lambda m: chr(int(m.group(1), 8)), line.split()[4])
+                            for line in f if len(line.split()) > 4]
+    except OSError:
+        return False
+    return any(point != '/' and (path == point or path.startswith(point.rstrip('/') + '/')) for point in mount_points)
+
+
+def is_sample_policy(filename):
+    with open(filename, 'rb') as f:
+        return decode_policy_bytes(f.read(), filename).lstrip().startswith(SAMPLE_POLICY_MARKER)
+
+
+def check_policy_source(filename):
+    in_container = running_in_container()
+    if not os.path.isfile(filename):
+        if in_container:
+            print(f"Error: Policy file '{filename}' not found inside the container.")
+            print(f"Mount your policy, e.g. 'docker run -v \"$(pwd)/policy.hujson:{os.path.abspath(filename)}\" ...',")
+            print("or point POLICY_FILE at the mounted path.")
+            exit(1)
+        return
+
+    if is_sample_policy(filename):
+        print("*" * 72)
+        print(f"WARNING: '{filename}' is the bundled EXAMPLE policy, not your tailnet's policy.")
+        run_warnings.append(f"'{filename}' is the bundled example policy")
+        if in_container:
+            print("Mount your own policy file into the container or set POLICY_FILE to its path.")
+        else:
+            print("Replace its contents with your policy or pass --policy.")
+        print("*" * 72)
+    elif in_container and not is_mounted_path(filename):
+        print(f"Note: '{filename}' is not a mounted file; using the copy built into the image.")
+
+
+def load_config(filename):
+    if filename is None:
+        return {}
+    config = load_json_or_hujson_file(filename)
+    if config is None:
+        print("Error: Could not parse config file")
+        exit(1)
+    return config
+
+
+def scan_policy(policy_text, scan_config):
+    # Works on the raw text rather than the parsed policy so comments are checked too
+    approved_ranges = [ipaddress.ip_network(r, strict=False)
+                       for r in scan_config.get('approved_ip_ranges', DEFAULT_APPROVED_IP_RANGES)]
+    personal_domains = {d.lower() for d in scan_config.get('personal_email_domains', DEFAULT_PERSONAL_EMAIL_DOMAINS)}
+    secret_patterns = {name: re.compile(pattern)
+                       for name, pattern in scan_config.get('secret_patterns', DEFAULT_SECRET_PATTERNS).items()}
+
+    findings = []
+    for line_number, line in enumerate(policy_text.splitlines(), start=1):
+        for match in list(IPV4_PATTERN.finditer(line)) + list(IPV6_PATTERN.finditer(line)):
+            try:
+                network = ipaddress.ip_network(match.group(0), strict=False)
+            except ValueError:
+                continue
+            if not any(network.version == r.version and network.subnet_of(r) for r in approved_ranges):
+                findings.append((line_number, 'unapproved-ip-range', f"{match.group(0)} is outside the approved IP ranges"))
+        for match in EMAIL_PATTERN.finditer(line):
+            if match.group(1).lower() in personal_domains:
+                findings.append((line_number, 'personal-email', f"{match.group(0)} uses a personal email domain"))
+        for name, pattern in secret_patterns.items():
+            if pattern.search(line):
+                findings.append((line_number, 'embedded-secret', f"possible secret ({name}) embedded in the policy"))
+    return findings
+
+
+def get_render_settings(preset, config):
+    # Later sources win: built-in defaults, then the preset, then the config file
+    settings = dict(DEFAULT_RENDER_SETTINGS)
+    for source in (RENDER_PRESETS.get(preset, {}), config.get('render', {})):
+        colors = dict(settings['colors'])
+        colors.update(source.get('colors', {}))
+        node_types = {node_type: dict(options) for node_type, options in settings['node_types'].items()}
+        for node_type, options in source.get('node_types', {}).items():
+            node_types.setdefault(node_type, {}).update(options)
+        settings.update(source)
+        settings['colors'] = colors
+        settings['node_types'] = node_types
+    return settings
+
+
+def resolve_protocol(proto):
+    # "tcp" -> ('tcp', 6), "ip-in-ip" -> ('ipv4', 4), "47" -> ('gre', 47)
+    if not isinstance(proto, str):
+        raise ValueError("proto must be a string")
+    name = proto.lower()
+    seen = set()
+    while isinstance(protocols.get(name), str) and name not in seen:
+        seen.add(name)
+        name = protocols[name].lower()
+    if isinstance(protocols.get(name), int):
+        return name, protocols[name]
+    if name.isdigit() and int(name) <= 255:
+        number = int(name)
+        names = [n for n, value in protocols.items() if value == number]
+        return (names[0] if names else name), number
+    raise ValueError(f"unknown proto '{proto}' (use a protocol number or one of {', '.join(sorted(protocols))})")
+
+
+def validate_autogroups(entries, position):
+    # Unknown autogroups, and autogroups used where they have no meaning
+    # (e.g. autogroup:self as a source)
+    problems = []
+    for entry in entries:
+        if not isinstance(entry, str) or not entry.startswith('autogroup:'):
+            continue
+        if entry not in AUTOGROUPS:
+            problems.append(f"unknown autogroup '{entry}'")
+        elif position not in AUTOGROUPS[entry][1]:
+            problems.append(f"'{entry}' can't be used in {position}")
+    return problems
+
+
+def validate_src_posture(rule):
+    posture = rule.get('srcPosture', [])
+    if not isinstance(posture, list) or not all(isinstance(p, str) and p.startswith('posture:') for p in posture):
+        return ["srcPosture must be a list of posture:name strings"]
+    return []
+
+
+def validate_rule_endpoints(rule):
+    problems = []
+    for field in ('src', 'dst'):
+        value = rule.get(field)
+        if not isinstance(value, list) or not value:
+            problems.append(f"{field} must be a non-empty list")
+        elif not all(isinstance(entry, str) for entry in value):
+            problems.append(f"{field} entries must be strings")
+        else:
+            problems += validate_autogroups([split_target(entry)[0] if field == 'dst' else entry for entry in value],
+                                            field)
+    return problems
+
+
+def parse_grant_ip(entry):
+    # "tcp:443" -> ('tcp', 6, '443'), "6:80-90" -> ('tcp', 6, '80-90'),
+    # "443" and "*" apply to every protocol -> (None, None, '443')
+    proto, sep, ports = entry.rpartition(':')
+    name, number = resolve_protocol(proto) if sep else (None, None)
+    try:
+        ranges = parse_ports(ports) if re.fullmatch(r"[\d,*-]+", ports) else None
+    except ValueError:
+        ranges = None
+    if not ranges or any(lo > hi or hi > 65535 for lo, hi in ranges):
+        raise ValueError(f"ip '{entry}' has an invalid port specification '{ports}'")
+    return name, number, ports
+
+
+def validate_grant(grant):
+    # Structural problems that would stop a grant from being mapped
+    if not isinstance(grant, dict):
+        return ["grant is not an object"]
+    problems = validate_rule_endpoints(grant) + validate_src_posture(grant)
+    if 'ip' not in grant and 'app' not in grant:
+        problems.append("grant needs an ip or app list")
+    if 'ip' in grant:
+        if not isinstance(grant['ip'], list) or not all(isinstance(entry, str) for entry in grant['ip']):
+            problems.append("ip must be a list of strings")
+        else:
+            for entry in grant['ip']:
+                try:
+                    parse_grant_ip(entry)
+                except ValueError as e:
+                    problems.append(str(e))
+    if 'app' in grant and not isinstance(grant['app'], dict):
+        problems.append("app must be an object")
+    return problems
+
+
+def validate_ssh_rule(rule):
+    # Structural problems that would stop an SSH rule from being mapped
+    if not isinstance(rule, dict):
+        return ["rule is not an object"]
+    problems = []
+    if rule.get('action') not in ('accept', 'check'):
+        problems.append(f"action must be \"accept\" or \"check\", got {json.dumps(rule.get('action'))}")
+    problems += validate_rule_endpoints(rule)
+    users = rule.get('users')
+    if not isinstance(users, list) or not users or not all(isinstance(user, str) for user in users):
+        problems.append("users must be a non-empty list of strings")
+    else:
+        problems += validate_autogroups(users, 'users')
+    return problems
+
+
+def validate_node_attr(entry):
+    # Structural problems in a nodeAttrs entry
+    if not isinstance(entry, dict):
+        return ["entry is not an object"]
+    problems = []
+    targets = entry.get('target')
+    if not isinstance(targets, list) or not targets:
+        problems.append("target must be a non-empty list")
+        targets = []
+    for target in targets:
+        if not isinstance(target, str):
+            problems.append("target entries must be strings")
+        elif not (target == '*' or target.startswith(('tag:', 'group:', 'autogroup:')) or '@' in target
+                  or is_ip_address(target)):
+            problems.append(f"target '{target}' is not a tag, group, autogroup, user, IP address or '*'")
+    if 'attr' not in entry and 'app' not in entry:
+        problems.append("entry needs an attr list or app object")
+    if 'attr' in entry and (not isinstance(entry['attr'], list) or not all(isinstance(a, str) for a in entry['attr'])):
+        problems.append("attr must be a list of strings")
+    if 'app' in entry and not isinstance(entry['app'], dict):
+        problems.append("app must be an object")
+    return problems
+
+
+def parse_host_value(value):
+    # "100.64.0.1" -> [100.64.0.1/32]; "10.0.0.0/8, 192.168.0.0/16" -> both
+    # networks. Raises ValueError for anything else.
+    if not isinstance(value, str):
+        raise ValueError(f"{json.dumps(value)} is not a string")
+    return [ipaddress.ip_network(part.strip(), strict=False) for part in value.split(',')]
+
+
+def validate_hosts(hosts):
+    # Returns the problems with the hosts section, the valid hosts and the
+    # hosts that stand for a whole network (a CIDR or several ranges) rather
+    # than one address
+    problems = []
+    valid = {}
+    networks = {}
+    for name, value in hosts.items():
+        try:
+            parsed = parse_host_value(value)
+        except ValueError as e:
+            problems.append(f"Host '{name}' has an invalid address {json.dumps(value)}: {e}")
+            continue
+        valid[name] = value
+        if len(parsed) > 1 or parsed[0].num_addresses > 1:
+            networks[name] = parsed
+    return problems, valid, networks
+
+
+def is_ip_address(value):
+    try:
+        ipaddress.ip_network(value, strict=False)
+    except ValueError:
+        return False
+    return True
+
+
+def resolve_protocols(proto):
+    # An ACL's "proto" may list several protocols, as an array or a
+    # comma-separated string: "tcp,udp" -> [('tcp', 6), ('udp', 17)]
+    if isinstance(proto, list):
+        if not proto or not all(isinstance(entry, str) for entry in proto):
+            raise ValueError("proto must be a string or a non-empty list of strings")
+        entries = [entry.strip() for entry in proto]
+    elif isinstance(proto, str):
+        entries = [entry.strip() for entry in proto.split(',')]
+    else:
+        raise ValueError("proto must be a string or a list of strings")
+    if not all(entries):
+        raise ValueError(f"proto '{proto}' has an empty entry")
+    return [resolve_protocol(entry) for entry in entries]
+
+
+def validate_acl_rule(rule):
+    # Structural problems that would stop a rule from being mapped
+    if not isinstance(rule, dict):
+        return ["rule is not an object"]
+    problems = []
+    if rule.get('action') != 'accept':
+        problems.append(f"action must be \"accept\", got {json.dumps(rule.get('action'))}")
+    problems += validate_rule_endpoints(rule) + validate_src_posture(rule)
+    if isinstance(rule.get('dst'), list):
+        for target in rule['dst']:
+            if not isinstance(target, str):
+                continue
+            base, sep, ports = partition_target(target)
+            if not sep or not base or not re.fullmatch(r"[\d,*-]+", ports):
+                problems.append(f"dst '{target}' has no port (use '{target}:*' for all ports)")
+                continue
+            try:
+                ranges = parse_ports(ports)
+            except ValueError:
+                ranges = None
+            if not ranges or any(lo > hi or hi > 65535 for lo, hi in ranges):
+                problems.append(f"dst '{target}' has an invalid port specification '{ports}'")
+    if 'proto' in rule:
+        try:
+            resolve_protocols(rule['proto'])
+        except ValueError as e:
+            problems.append(str(e))
+    return problems
+
+
+def json_type_name(value):
+    return next((name for name, check in JSON_SCHEMA_TYPES.items() if check(value)), 'null')
+
+
+def validate_schema(value, schema, path="", root=None):
+    # Checks value against a schema using the keywords POLICY_SCHEMA uses.
+    # Returns (JSON Pointer, message) pairs, e.g. ("/grants/3/ip/0", ...).
+    root = root or schema
+    if '$ref' in schema:
+        schema = root['$defs'][schema['$ref'].rpartition('/')[2]]
+    expected = schema.get('type')
+    if expected and not JSON_SCHEMA_TYPES[expected](value):
+        return [(path, f"expected {expected}, got {json_type_name(value)}")]
+    errors = []
+    if 'enum' in schema and value not in schema['enum']:
+        errors.append((path, f"{json.dumps(value)} is not one of {', '.join(json.dumps(v) for v in schema['enum'])}"))
+    if 'pattern' in schema and isinstance(value, str) and not re.search(schema['pattern'], value):
+        errors.append((path, f"{json.dumps(value)} does not match the pattern {schema['pattern']}"))
+    if 'anyOf' in schema and all(validate_schema(value, option, path, root) for option in schema['anyOf']):
+        errors.append((path, schema.get('description', "does not match any of the allowed forms")))
+    if isinstance(value, list):
+        if len(value) < schema.get('minItems', 0):
+            errors.append((path, f"needs at least {schema['minItems']} item(s)"))
+        if 'items' in schema:
+            for index, item in enumerate(value):
+                errors += validate_schema(item, schema['items'], f"{path}/{index}", root)
+    if isinstance(value, dict):
+        for key in schema.get('required', []):
+            if key not in value:
+                errors.append((path, f"missing required property '{key}'"))
+        for key, item in value.items():
+            # JSON Pointer escapes "~" and "/", which route keys contain
+            child = f"{path}/{key.replace('~', '~0').replace('/', '~1')}"
+            subschema = schema.get('properties', {}).get(key)
+            if subschema is None:
+                subschema = next((s for pattern, s in schema.get('patternProperties', {}).items()
+                                  if re.search(pattern, key)), None)
+            if subschema is None:
+                subschema = schema.get('additionalProperties', True)
+                if subschema is False:
+                    errors.append((child, f"unknown property '{key}'"))
+                    continue
+                if subschema is True:
+                    continue
+            errors += validate_schema(item, subschema, child, root)
+    return errors
+
+
+def get_schema_errors(policy, sources, provenance):
+    # Schema problems as messages, with the file and line of the rule or
+    # definition each one is in
+    messages = []
+    for path, message in validate_schema(policy, POLICY_SCHEMA):
+        parts = path.split('/')
+        location = None
+        if len(parts) > 2 and isinstance(policy.get(parts[1]), list) and parts[2].isdigit():
+            location = get_rule_location(parts[1], int(parts[2]), sources, provenance)
+        elif len(parts) > 2 and isinstance(policy.get(parts[1]), dict):
+            key = parts[2].replace('~1', '/').replace('~0', '~')
+            location = get_definition_location(parts[1], key, sources, provenance)
+        where = f" ({location[0]}, line {location[1]})" if location else ""
+        messages.append(f"Schema: {path or '/'}{where}: {message}")
+    return messages
+
+
+def validate_rules(section, rules, sources, provenance):
+    # Returns the rules of an "acls" or "grants" section that passed, and
+    # (description, problems) for the ones that didn't
+    validate, label = {
+        'acls': (validate_acl_rule, "ACL rule"),
+        'grants': (validate_grant, "Grant"),
+        'ssh': (validate_ssh_rule, "SSH rule"),
+        'nodeAttrs': (validate_node_attr, "nodeAttrs entry"),
+    }[section]
+    valid = []
+    valid_origins = []
+    skipped = []
+    origins = provenance.get(section, [])
+    for index, rule in enumerate(rules):
+        problems = validate(rule)
+        if not problems:
+            valid.append(rule)
+            valid_origins.append(origins[index])
+            continue
+        location = get_rule_location(section, index, sources, provenance)
+        where = f" ({location[0]}, line {location[1]}, column {location[2]})" if location else ""
+        skipped.append((f"{label} #{index}{where}", problems))
+    provenance[section] = valid_origins
+    return valid, skipped
+
+
+def parse_posture_value(text):
+    text = text.strip()
+    if len(text) >= 2 and text[0] == text[-1] and text[0] in '\'"':
+        return text[1:-1]
+    if not text or any(c in text for c in '\'"[], '):
+        raise ValueError(f"can't parse value '{text}'")
+    return text
+
+
+def parse_posture_expression(expression):
+    # "node:tsVersion >= '1.40'" -> ('node:tsVersion', '>=', '1.40'). IN and
+    # NOT IN take a list, IS SET and NOT SET take no value. Raises ValueError
+    # with the reason when the expression is malformed.
+    match = POSTURE_EXPRESSION_PATTERN.match(expression)
+    if not match:
+        raise ValueError("expected '<attribute> <operator> <value>', e.g. \"node:os == 'macos'\"")
+    attribute, operator, value = match.group('attribute', 'operator', 'value')
+    if operator in ('IS SET', 'NOT SET'):
+        if value:
+            raise ValueError(f"{operator} does not take a value")
+        return attribute, operator, None
+    if not value:
+        raise ValueError(f"{operator} needs a value")
+    if operator in ('IN', 'NOT IN'):
+        if not (value.startswith('[') and value.endswith(']')):
+            raise ValueError(f"{operator} needs a list such as ['macos', 'windows']")
+        items = [item for item in re.split(r",(?=(?:[^'\"]|'[^']*'|\"[^\"]*\")*$)", value[1:-1]) if item.strip()]
+        return attribute, operator, [parse_posture_value(item) for item in items]
+    if value.startswith('['):
+        raise ValueError(f"{operator} compares against a single value, not a list")
+    return attribute, operator, parse_posture_value(value)
+
+
+def compare_versions(a, b):
+    # '1.40.2' vs '1.40' -> 1; non-numeric parts are compared as strings
+    def key(version):
+        return [(0, int(part), '') if part.isdigit() else (1, 0, part) for part in re.split(r"[.-]", str(version))]
+    a_key, b_key = key(a), key(b)
+    length = max(len(a_key), len(b_key))
+    a_key += [(0, 0, '')] * (length - len(a_key))
+    b_key += [(0, 0, '')] * (length - len(b_key))
+    return (a_key > b_key) - (a_key < b_key)
+
+
+def evaluate_posture_expression(parsed, attributes):
+    attribute, operator, value = parsed
+    if operator == 'IS SET':
+        return attribute in attributes
+    if operator == 'NOT SET':
+        return attribute not in attributes
+    if attribute not in attributes:
+        return False
+    actual = str(attributes[attribute]).lower() if isinstance(attributes[attribute], bool) else str(attributes[attribute])
+    if operator == '==':
+        return actual == value
+    if operator == '!=':
+        return actual != value
+    if operator == 'IN':
+        return actual in value
+    if operator == 'NOT IN':
+        return actual not in value
+    comparison = compare_versions(actual, value)
+    return {'<': comparison < 0, '<=': comparison <= 0, '>': comparison > 0, '>=': comparison >= 0}[operator]
+
+
+def validate_postures(postures):
+    # Returns (posture, expression, reason) for every expression that doesn't parse
+    problems = []
+    for posture, expressions in postures.items():
+        if not posture.startswith('posture:'):
+            problems.append((posture, None, "posture names must start with 'posture:'"))
+        if not isinstance(expressions, list):
+            problems.append((posture, None, "must be a list of expressions"))
+            continue
+        for expression in expressions:
+            try:
+                parse_posture_expression(expression if isinstance(expression, str) else '')
+            except ValueError as e:
+                problems.append((posture, expression, str(e)))
+    return problems
+
+
+def evaluate_postures(postures, devices_file):
+    # Prints which postures each device satisfies, given a JSON/HuJSON file of
+    # {"device": {"node:os": "macos", "node:tsVersion": "1.62.0", ...}}
+    devices = load_json_or_hujson_file(devices_file)
+    if devices is None:
+        print("Error: Could not parse device attributes file")
+        exit(1)
+    parsed = {posture: [parse_posture_expression(e) for e in expressions] for posture, expressions in postures.items()}
+    for device, attributes in devices.items():
+        print(f"{device}:")
+        for posture, expressions in parsed.items():
+            failed = [postures[posture][i] for i, e in enumerate(expressions)
+                      if not evaluate_posture_expression(e, attributes)]
+            if failed:
+                print(f"  {posture}: fails {', '.join(failed)}")
+            else:
+                print(f"  {posture}: passes")
+
+
+def find_undefined_references(policy):
+    # Groups, tags, hosts and postures used somewhere in the policy but never
+    # defined. Returns (where, reference) pairs.
+    groups = policy.get('groups', {})
+    tag_owners = policy.get('tagOwners', {})
+    hosts = policy.get('hosts', {})
+    postures = policy.get('postures', {})
+    ipsets = policy.get('ipsets', {})
+    problems = []
+
+    def check(where, entry, allow_hosts):
+        if not isinstance(entry, str):
+            return
+        if entry.startswith('group:'):
+            defined = entry in groups
+        elif entry.startswith('tag:'):
+            defined = entry in tag_owners
+        elif entry.startswith('posture:'):
+            defined = entry in postures
+        elif entry.startswith('ipset:'):
+            defined = entry in ipsets
+        elif allow_hosts and entry != '*' and ':' not in entry and '@' not in entry and '/' not in entry \
+                and not is_ip_address(entry):
+            defined = entry in hosts
+        else:
+            defined = True
+        if not defined:
+            problems.append((where, entry))
+
+    for group, members in groups.items():
+        for member in members if isinstance(members, list) else []:
+            check(group, member, False)
+    for tag, owners in tag_owners.items():
+        for owner in owners if isinstance(owners, list) else []:
+            check(f"tagOwners {tag}", owner, False)
+    for section in ('acls', 'grants', 'ssh'):
+        for index, rule in enumerate(policy.get(section, [])):
+            if not isinstance(rule, dict):
+                continue
+            where = f"{section.rstrip('s')} rule #{index}"
+            for src in rule.get('src', []) if isinstance(rule.get('src'), list) else []:
+                check(where, src, True)
+            for dst in rule.get('dst', []) if isinstance(rule.get('dst'), list) else []:
+                check(where, split_target(dst)[0] if section == 'acls' and isinstance(dst, str) else dst, True)
+            for posture in rule.get('srcPosture', []) if isinstance(rule.get('srcPosture'), list) else []:
+                check(where, posture, False)
+            for via in rule.get('via', []) if isinstance(rule.get('via'), list) else []:
+                check(where, via, True)
+    for name, entries in ipsets.items():
+        for entry in entries if isinstance(entries, list) else []:
+            if isinstance(entry, str):
+                target = IPSET_OPERATION_PATTERN.sub('', entry)
+                if target.startswith('host:'):
+                    check(f"ipsets {name}", target[len('host:'):], True)
+                elif target.startswith('ipset:'):
+                    check(f"ipsets {name}", target, False)
+    auto_approvers = policy.get('autoApprovers', {})
+    for route, approvers in auto_approvers.get('routes', {}).items():
+        for approver in approvers if isinstance(approvers, list) else []:
+            check(f"autoApprovers route {route}", approver, False)
+    for approver in auto_approvers.get('exitNode', []) if isinstance(auto_approvers.get('exitNode'), list) else []:
+        check("autoApprovers exitNode", approver, False)
+    for posture in policy.get('defaultSrcPosture', []) if isinstance(policy.get('defaultSrcPosture'), list) else []:
+        check("defaultSrcPosture", posture, False)
+    return problems
+
+
+def find_unreferenced_definitions(policy):
+    # Groups, hosts, tags and postures that no ACL, grant or SSH rule uses,
+    # directly or through a group or IP set they use. Owners in tagOwners,
+    # autoApprovers, nodeAttrs and defaultSrcPosture also count as uses.
+    # Returns (section, name) pairs.
+    groups = policy.get('groups', {})
+    ipsets = policy.get('ipsets', {})
+    referenced = set()
+
+    def entries(value):
+        return [entry for entry in value if isinstance(entry, str)] if isinstance(value, list) else []
+
+    for section in ('acls', 'grants', 'ssh'):
+        for rule in policy.get(section, []):
+            if not isinstance(rule, dict):
+                continue
+            referenced.update(entries(rule.get('src')) + entries(rule.get('srcPosture')) + entries(rule.get('via')))
+            for dst in entries(rule.get('dst')):
+                referenced.add(split_target(dst)[0] if section == 'acls' else dst)
+    tag_owners = policy.get('tagOwners', {})
+    for owners in tag_owners.values() if isinstance(tag_owners, dict) else []:
+        referenced.update(entries(owners))
+    auto_approvers = policy.get('autoApprovers', {})
+    for approvers in auto_approvers.get('routes', {}).values():
+        referenced.update(entries(approvers))
+    referenced.update(entries(auto_approvers.get('exitNode')))
+    for node_attr in policy.get('nodeAttrs', []):
+        if isinstance(node_attr, dict):
+            referenced.update(entries(node_attr.get('target')))
+    referenced.update(entries(policy.get('defaultSrcPosture')))
+    pending = list(referenced)
+    while pending:
+        entry = pending.pop()
+        members = groups.get(entry) if entry.startswith('group:') else ipsets.get(entry)
+        for member in entries(members):
+            member = IPSET_OPERATION_PATTERN.sub('', member)
+            if member.startswith('host:'):
+                member = member[len('host:'):]
+            if member not in referenced:
+                referenced.add(member)
+                pending.append(member)
+    return [(section, name) for section in ('groups', 'hosts', 'tagOwners', 'postures')
+            for name in policy.get(section, {}) if name not in referenced]
+
+
+def validate_ipsets(ipsets):
+    # Each entry is an address, CIDR, address range, host:NAME or another
+    # ipset:NAME, optionally prefixed by "add" or "remove"
+    problems = []
+    for name, entries in ipsets.items():
+        if not name.startswith('ipset:'):
+            problems.append(f"IP set '{name}' must be named ipset:NAME")
+        if not isinstance(entries, list) or not all(isinstance(entry, str) for entry in entries):
+            problems.append(f"IP set '{name}' must be a list of strings")
+            continue
+        for entry in entries:
+            target = IPSET_OPERATION_PATTERN.sub('', entry)
+            first, _, last = target.partition('-')
+            if not (target.startswith(('host:', 'ipset:')) or is_ip_address(target)
+                    or (last and is_ip_address(first) and is_ip_address(last))):
+                problems.append(f"IP set '{name}' entry '{entry}' is not an address, CIDR, range, host: or ipset:")
+    return problems
+
+
+def find_host_conflicts(hosts, groups, tag_owners):
+    # Host names sharing an address, and host names that are also used as a
+    # group or tag name, end up as separate nodes for the same thing
+    problems = []
+    names_by_address = {}
+    for name, address in hosts.items():
+        names_by_address.setdefault(address, []).append(name)
+    for address, names in names_by_address.items():
+        if len(names) > 1:
+            problems.append(f"Hosts {', '.join(names)} all point to {address}")
+    for name in hosts:
+        for prefix, definitions, kind in (('group:', groups, 'group'), ('tag:', tag_owners, 'tag')):
+            if prefix + name in definitions:
+                problems.append(f"Host '{name}' has the same name as {kind} '{prefix + name}'")
+    return problems
+
+
+def find_disallowed_members(groups, tag_owners, allowed_domains):
+    # Group members and tag owners whose email domain isn't in allowed_domains
+    allowed = {domain.lower() for domain in allowed_domains}
+    problems = []
+    for section, definitions in (('group', groups), ('tagOwners', tag_owners)):
+        for name, members in definitions.items():
+            for member in members if isinstance(members, list) else []:
+                if isinstance(member, str) and '@' in member and member.rpartition('@')[2].lower() not in allowed:
+                    problems.append(f"{member} in {section} {name} is not from an allowed domain")
+    return problems
+
+
+def merge_acls(acls):
+    # Preprocess ACL rules to merge nodes with similar hostnames
+    merged_acls = []
+    for rule in acls:
+        src = set()
+        dst = set()
+        for node in rule['src']:
+            if node.startswith('tag:'):
+                src.add(node)  # Preserve the entire tag format
+                #src.add(node.split(':')[1])  # Extract tag name
+            elif node.startswith('autogroup:'):
+                src.add(node)  # Preserve the entire autogroup format
+            elif node.startswith('group:'):
+                src.add(node)  # Preserve the entire group format
+                #src.add(node.split(':')[1])  # Extract group name
+            elif node.startswith('ipset:'):
+                src.add(node)  # Preserve the entire ipset format
+            elif is_ip_address(node):
+                src.add(node)  # IPv6 addresses contain colons of their own
+            else:
+                hostname = node.split(':')[0]  # Extract hostname
+                src.add(hostname)
+        dst_ports = {}
+        for node in rule['dst']:
+            # "tag:dev:22" and "server1:5432" point at the tag:dev and server1
+            # nodes; the ports are kept for the edge
+            base, ports = split_target(node)
+            dst.add(base)
+            dst_ports.setdefault(base, []).append(ports)
+        merged_rule = {'action': rule['action'], 'src': src, 'dst': dst, 'dst_ports': dst_ports}
+        if 'proto' in rule:
+            merged_rule['proto'] = resolve_protocols(rule['proto'])
+        if rule.get('srcPosture'):
+            merged_rule['src_posture'] = rule['srcPosture']
+        merged_acls.append(merged_rule)
+    return merged_acls
+
+
+def get_node_type(node):
+    if node.startswith('tag:'):
+        return 'tag'
+    elif node.startswith('derp:'):
+        return 'derp'
+    elif node.startswith('ipset:'):
+        return 'ipset'
+    elif COMPANY_DOMAIN in node:
+        return 'group'
+    elif node.startswith('autogroup:'):
+        return 'group'
+    elif node.startswith('group:'):
+        return 'group'
+    elif node in network_hosts:
+        return 'network'
+    else:
+        return 'host'
+
+
+def get_node_color(node):
+    return node_colors[get_node_type(node)]
+
+
+def get_node_label(node, labels):
+    if labels == 'none':
+        return ' '
+    if labels == 'short':
+        for prefix in ('tag:', 'group:', 'autogroup:'):
+            if node.startswith(prefix):
+                return node[len(prefix):]
+    return node
+
+
+def add_policy_node(net, node, settings, attrs=None):
+    attrs = attrs or {}
+    if settings['wildcard_nodes'] and node in PSEUDO_NODES:
+        label, description = PSEUDO_NODES[node]
+        net.add_node(node, label=label, title=f"{node}: {description}", color=node_colors['wildcard'], shape='diamond')
+        return
+    title = attrs.get('title', node)
+    if node in AUTOGROUPS:
+        title += f"\n{AUTOGROUPS[node][0]}"
+    if attrs.get('members'):
+        title += "\n" + "\n".join(attrs['members'])
+    for network in network_hosts.get(node, []):
+        title += f"\nNetwork {network} ({network.num_addresses:,} addresses)"
+    if attrs.get('defined_at'):
+        title += "\nDefined in {}, line {}, column {}".format(*attrs['defined_at'])
+    if attrs.get('self_access'):
+        # autogroup:self is shown as a badge rather than a node of its own
+        ports = ', '.join(sorted(attrs['self_access']))
+        title += f"\nCan access their own devices (autogroup:self) on ports {ports}"
+    extra = {}
+    if attrs.get('node_attrs'):
+        # Also kept as a node property so the filter menu can search on it
+        extra['node_attrs'] = ', '.join(sorted(attrs['node_attrs']))
+        title += f"\nNode attributes: {extra['node_attrs']}"
+    if attrs.get('orphan'):
+        title += "\nNot used by any rule"
+    label = get_node_label(attrs.get('label', node), settings['labels'])
+    if attrs.get('self_access') and settings['labels'] != 'none':
+        label += " \u21bb"
+    color = node_colors['orphan'] if attrs.get('orphan') else get_node_color(node)
+    net.add_node(node, label=label, title=title, color=color, **extra)
+
+
+def new_graph():
+    # Nodes map to extra attributes; edges are (source, destination, options)
+    return {'nodes': {}, 'edges': []}
+
+
+def add_graph_node(graph, node):
+    graph['nodes'].setdefault(node, {})
+
+
+def add_graph_edge(graph, src, dst, **options):
+    add_graph_node(graph, src)
+    add_graph_node(graph, dst)
+    graph['edges'].append((src, dst, options))
+
+
+def join_names(names, conjunction):
+    # ["a", "b", "c"] -> "a, b and c"
+    names = list(names)
+    if len(names) <= 1:
+        return "".join(names)
+    return f"{', '.join(names[:-1])} {conjunction} {names[-1]}"
+
+
+def summarize_rule(section, rule, templates):
+    # One sentence for a merged ACL rule, grant or SSH rule, e.g. "Developers
+    # can SSH to dev servers as ubuntu from devices matching posture:corp"
+    def names(entries):
+        return join_names([templates['names'].get(entry, entry) for entry in entries], templates['and'])
+
+    postures = rule.get('src_posture' if section == 'acls' else 'srcPosture')
+    fields = {
+        'src': names(rule['src']),
+        'dst': names(rule['dst']),
+        'posture': templates['posture'].format(postures=names(postures)) if postures else "",
+    }
+    key = section
+    if section == 'acls':
+        fields['ports'] = join_names(sorted({p for ports in rule['dst_ports'].values() for p in ports}), templates['and'])
+    elif section == 'grants':
+        fields['ports'] = join_names(list(rule.get('ip', [])) + [f"app {app}" for app in rule.get('app', {})],
+                                     templates['and'])
+    else:
+        fields['users'] = names(rule['users'])
+        key = 'ssh_check' if rule['action'] == 'check' else 'ssh'
+    try:
+        return templates[key].format(**fields)
+    except (KeyError, IndexError, ValueError) as e:
+        warn(f"Invalid '{key}' summary template '{templates[key]}' ({e}); using the default")
+        return DEFAULT_SUMMARY_TEMPLATES[key].format(**fields)
+
+
+def get_rule_summaries(merged_acls, grants, ssh_rules, summaries_config):
+    templates = dict(DEFAULT_SUMMARY_TEMPLATES, **summaries_config)
+    return {
+        'acls': [summarize_rule('acls', rule, templates) for rule in merged_acls],
+        'grants': [summarize_rule('grants', grant, templates) for grant in grants],
+        'ssh': [summarize_rule('ssh', rule, templates) for rule in ssh_rules],
+    }
+
+
+def add_expiry_options(options, notes, expires):
+    # Time-bound access is dashed (SSH edges keep their dots), and red once it
+    # has expired
+    expired = expires < date.today()
+    options.setdefault('dashes', True)
+    if expired:
+        options['color'] = "#cc0000"
+    notes.append(f"{'Expired' if expired else 'Expires'} {expires.isoformat()}")
+
+
+def add_acl_edges(graph, merged_acls, summaries=None):
+    # Add nodes and edges based on preprocessed ACL rules
+    for index, rule in enumerate(merged_acls):
+        summary = [summaries[index]] if summaries else []
+        for src in rule['src']:
+            add_graph_node(graph, src)
+            for dst in rule['dst']:
+                ports = ",".join(rule['dst_ports'][dst])
+                if dst == 'autogroup:self':
+                    # Not a shared destination: each source can only reach its own devices
+                    graph['nodes'][src].setdefault('self_access', set()).add(ports)
+                    add_graph_edge(graph, src, src, label="self", arrows={'to': {'enabled': True}},
+                                   title="\n".join(summary + [f"Can reach their own devices on ports {ports} (autogroup:self)"]))
+                    continue
+                options = {'arrows': {'to': {'enabled': True}}}  # Specify arrow options as a dictionary
+                notes = summary + [f"Ports {ports}"]
+                if 'proto' in rule:
+                    options['label'] = ", ".join(name for name, _ in rule['proto'])
+                    notes.append(f"Protocols {', '.join(f'{name} ({number})' for name, number in rule['proto'])} only")
+                if 'src_posture' in rule:
+                    notes.append(f"Requires device posture: {', '.join(rule['src_posture'])}")
+                if 'expires' in rule:
+                    add_expiry_options(options, notes, rule['expires'])
+                options['title'] = "\n".join(notes)
+                add_graph_edge(graph, src, dst, **options)
+
+
+def add_grant_edges(graph, grants, summaries=None, expiries=None):
+    # Grants name their ports in "ip" (and application capabilities in "app")
+    # rather than on the destination, so they go in the edge tooltip
+    for index, grant in enumerate(grants):
+        options = {'arrows': {'to': {'enabled': True}}}
+        notes = [summaries[index]] if summaries else []
+        for entry in grant.get('ip', []):
+            name, number, ports = parse_grant_ip(entry)
+            notes.append(f"{name} ({number}) ports {ports}" if name else f"All protocols, ports {ports}")
+        notes += [f"App capability {app}" for app in grant.get('app', {})]
+        if grant.get('srcPosture'):
+            notes.append(f"Requires device posture: {', '.join(grant['srcPosture'])}")
+        if grant.get('via'):
+            notes.append(f"Via {', '.join(grant['via'])}")
+        # Fields this version doesn't know about (e.g. newer grant conditions)
+        # are shown as-is rather than dropped
+        notes += [f"{key}: {json.dumps(value)}" for key, value in grant.items() if key not in GRANT_FIELDS]
+        if expiries and expiries[index] is not None:
+            add_expiry_options(options, notes, expiries[index])
+        for src in grant['src']:
+            add_graph_node(graph, src)
+            for dst in grant['dst']:
+                if dst == 'autogroup:self':
+                    # Same as for ACLs: a loop on the source, not a shared node
+                    ports = ",".join(grant.get('ip', [])) or "app capabilities only"
+                    graph['nodes'][src].setdefault('self_access', set()).add(ports)
+                    add_graph_edge(graph, src, src, label="self", **dict(
+                        options, title="Grant\n" + "\n".join(notes + ["Only to their own devices (autogroup:self)"])))
+                    continue
+                add_graph_edge(graph, src, dst, **dict(options, title="Grant\n" + "\n".join(notes)))
+
+
+def add_ssh_edges(graph, ssh_rules, summaries=None, expiries=None):
+    # Tailscale SSH access is drawn as dotted edges in its own color, with the
+    # local users it allows in the tooltip
+    for index, rule in enumerate(ssh_rules):
+        options = {'arrows': {'to': {'enabled': True}}, 'color': node_colors['ssh'], 'dashes': [2, 4], 'label': "ssh"}
+        notes = ([summaries[index]] if summaries else []) + [f"SSH as {', '.join(rule['users'])}"]
+        if rule['action'] == 'check':
+            notes.append(f"Check mode: re-authenticate every {rule.get('checkPeriod', '12h')}")
+        if expiries and expiries[index] is not None:
+            add_expiry_options(options, notes, expiries[index])
+        title = "\n".join(notes)
+        for src in rule['src']:
+            for dst in rule['dst']:
+                if dst == 'autogroup:self':
+                    add_graph_edge(graph, src, src, **dict(
+                        options, title=f"{title}\nOnly to their own devices (autogroup:self)"))
+                    continue
+                add_graph_edge(graph, src, dst, **dict(options, title=title))
+
+
+def add_node_attrs(graph, node_attrs, hosts):
+    # Attributes and app capabilities from nodeAttrs are attached to the nodes
+    # they target (hosts are matched by address too); targets that aren't in
+    # the graph are left out rather than drawn as lone nodes
+    for entry in node_attrs:
+        values = set(entry.get('attr', [])) | {f"app {app}" for app in entry.get('app', {})}
+        for target in entry['target']:
+            for node in [target] + [name for name, address in hosts.items() if address == target]:
+                if node in graph['nodes']:
+                    graph['nodes'][node].setdefault('node_attrs', set()).update(values)
+
+
+def validate_auto_approvers(auto_approvers):
+    # Returns the routes and exit node approvers that can be mapped, warning
+    # about the rest
+    routes = {}
+    for route, approvers in auto_approvers.get('routes', {}).items():
+        if not is_ip_address(route):
+            warn(f"autoApprovers route '{route}' is not a valid IP prefix")
+        elif not isinstance(approvers, list) or not all(isinstance(a, str) for a in approvers):
+            warn(f"autoApprovers route '{route}' must list its approvers as strings")
+        else:
+            routes[route] = approvers
+    exit_node = auto_approvers.get('exitNode', [])
+    if not isinstance(exit_node, list) or not all(isinstance(a, str) for a in exit_node):
+        warn("autoApprovers exitNode must be a list of strings")
+        exit_node = []
+    return routes, exit_node
+
+
+def add_auto_approver_edges(graph, routes, exit_node):
+    # Devices owned by (or tagged as) an approver can advertise these routes
+    # without an admin approving them
+    for route, approvers in routes.items():
+        for approver in approvers:
+            add_graph_edge(graph, approver, route, color=node_colors['approval'], dashes=[8, 4], label="approves",
+                           title=f"Routes to {route} advertised by {approver} are approved automatically",
+                           arrows={'to': {'enabled': True}})
+    for approver in exit_node:
+        add_graph_edge(graph, approver, EXIT_NODE, color=node_colors['approval'], dashes=[8, 4], label="approves",
+                       title=f"Devices of {approver} can become exit nodes without manual approval",
+                       arrows={'to': {'enabled': True}})
+
+
+def add_derp_nodes(graph, derp_map):
+    # Custom DERP regions from derpMap, each linked to its relay servers. Which
+    # region a device prefers is only known to a live tailnet, so devices are
+    # not connected to them.
+    for region_key, region in derp_map.get('Regions', {}).items():
+        if not isinstance(region, dict):
+            warn(f"derpMap region '{region_key}' is not an object")
+            continue
+        if str(region.get('RegionID', region_key)) != str(region_key):
+            warn(f"derpMap region '{region_key}' has RegionID {region.get('RegionID')}")
+        region_node = f"derp:{region_key}"
+        name = region.get('RegionName') or region.get('RegionCode') or region_key
+        graph['nodes'].setdefault(region_node, {}).update(label=f"DERP {name}", title=(
+            f"DERP region {region_key}: {name}" + (f" ({region['RegionCode']})" if region.get('RegionCode') else "")))
+        for node in region.get('Nodes', []):
+            if not isinstance(node, dict) or not node.get('HostName'):
+                warn(f"derpMap region '{region_key}' has a node without a HostName")
+                continue
+            server = f"derp:{region_key}/{node.get('Name', node['HostName'])}"
+            addresses = [node[key] for key in ('IPv4', 'IPv6') if node.get(key)]
+            port = node.get('DERPPort', 443)
+            graph['nodes'].setdefault(server, {}).update(label=node['HostName'], title=(
+                f"DERP server {node['HostName']}:{port}" + (f" ({', '.join(addresses)})" if addresses else "")))
+            add_graph_edge(graph, region_node, server, color=node_colors['derp'], title="relay server")
+
+
+def add_tag_owner_edges(graph, tag_owners):
+    # Ownership edges are dashed and colored separately so "who can tag what"
+    # does not get confused with "who can reach what"
+    for tag, owners in tag_owners.items():
+        add_graph_node(graph, tag)
+        for owner in owners:
+            add_graph_edge(graph, tag, owner, color=node_colors['ownership'], dashes=True, title="owned by",
+                           arrows={'to': {'enabled': True}})
+
+
+def merge_graph_nodes(graph, merge_rules):
+    # Config-defined merges: every node matching one of a rule's "nodes"
+    # patterns is replaced by the rule's "into" node, so aliases of the same
+    # machine (or a family of tags) show up once
+    renamed = {}
+    for rule in merge_rules:
+        matched = [node for node in graph['nodes'] if node not in renamed and node != rule['into']
+                   and any(fnmatch.fnmatch(node, pattern) for pattern in rule['nodes'])]
+        if not matched:
+            warn(f"Merge rule for '{rule['into']}' did not match any node")
+        for node in matched:
+            renamed[node] = rule['into']
+    if not renamed:
+        return graph
+    nodes = {}
+    for node, attrs in graph['nodes'].items():
+        target = renamed.get(node, node)
+        merged = nodes.setdefault(target, {})
+        for key, value in attrs.items():
+            if isinstance(value, set):
+                merged.setdefault(key, set()).update(value)
+            else:
+                merged.setdefault(key, value)
+        if node != target:
+            merged['members'] = sorted(set(merged.get('members', [])) | {node})
+    edges = []
+    seen = set()
+    for src, dst, options in graph['edges']:
+        new_src, new_dst = renamed.get(src, src), renamed.get(dst, dst)
+        if new_src == new_dst and src != dst:
+            # Access between two merged aliases says nothing on the merged map
+            continue
+        key = (new_src, new_dst, canonical_json(options))
+        if key not in seen:
+            seen.add(key)
+            edges.append((new_src, new_dst, options))
+    return {'nodes': nodes, 'edges': edges}
+
+
+def filter_graph(graph, include, exclude):
+    # Excluded nodes are dropped along with their edges. With include patterns,
+    # only edges touching an included node are kept, so the included nodes
+    # still show who reaches them and what they reach.
+    def excluded(node):
+        return any(fnmatch.fnmatch(node, pattern) for pattern in exclude)
+
+    def included(node):
+        return any(fnmatch.fnmatch(node, pattern) for pattern in include)
+
+    edges = [edge for edge in graph['edges'] if not excluded(edge[0]) and not excluded(edge[1])]
+    if include:
+        edges = [edge for edge in edges if included(edge[0]) or included(edge[1])]
+    connected = {node for edge in edges for node in edge[:2]}
+    nodes = {node: attrs for node, attrs in graph['nodes'].items()
+             if not excluded(node) and (not include or included(node) or node in connected)}
+    return {'nodes': nodes, 'edges': edges}
+
+
+def get_redactions(graph, patterns):
+    # Placeholder names for the nodes matching a redact pattern, numbered in
+    # name order. The tag:/group:/ipset: prefix is kept so the node keeps its
+    # color and layer.
+    redactions = {}
+    for node in sorted(graph['nodes']):
+        if any(fnmatch.fnmatch(node, pattern) for pattern in patterns):
+            prefix = next((p for p in ('tag:', 'group:', 'ipset:', 'autogroup:') if node.startswith(p)), '')
+            redactions[node] = f"{prefix}redacted-{len(redactions) + 1}"
+    return redactions
+
+
+def redact_value(value, redactions):
+    # Replaces redacted names wherever they appear in text, e.g. in edge
+    # tooltips, rule summaries and "tag:secret:443"
+    if not redactions:
+        return value
+    if isinstance(value, dict):
+        return {redact_value(key, redactions): redact_value(item, redactions) for key, item in value.items()}
+    if isinstance(value, (list, tuple, set)):
+        return type(value)(redact_value(item, redactions) for item in value)
+    if not isinstance(value, str):
+        return value
+    names = "|".join(re.escape(name) for name in sorted(redactions, key=len, reverse=True))
+    return re.sub(rf"(?<![\w.@:-])({names})(?![\w.@-])", lambda m: redactions[m.group(1)], value)
+
+
+def redact_graph(graph, redactions):
+    # Redacted nodes keep their edges but lose their name, members and
+    # everything else in their tooltip
+    nodes = {}
+    for node, attrs in graph['nodes'].items():
+        nodes[redactions.get(node, node)] = {} if node in redactions else redact_value(attrs, redactions)
+    edges = [(redactions.get(src, src), redactions.get(dst, dst), redact_value(options, redactions))
+             for src, dst, options in graph['edges']]
+    return {'nodes': nodes, 'edges': edges}
+
+
+def focus_graph(graph, focus, depth):
+    # Keep only what is within `depth` hops of the focus node, following
+    # edges in either direction
+    neighbors = {}
+    for src, dst, _ in graph['edges']:
+        neighbors.setdefault(src, set()).add(dst)
+        neighbors.setdefault(dst, set()).add(src)
+    keep = {focus}
+    frontier = {focus}
+    for _ in range(depth):
+        frontier = {n for node in frontier for n in neighbors.get(node, ())} - keep
+        keep |= frontier
+    return {
+        'nodes': {node: attrs for node, attrs in graph['nodes'].items() if node in keep},
+        'edges': [edge for edge in graph['edges'] if edge[0] in keep and edge[1] in keep],
+    }
+
+
+def aggregate_leaf_hosts(graph):
+    # Hosts connected to a single other node, all in the same direction, are
+    # folded into one "N hosts" node per neighbor. The aggregate's tooltip
+    # lists the hosts it stands for.
+    links = {}
+    for src, dst, _ in graph['edges']:
+        links.setdefault(src, set()).add((dst, 'out'))
+        links.setdefault(dst, set()).add((src, 'in'))
+    leaves = {}
+    for node, node_links in links.items():
+        if get_node_type(node) == 'host' and len(node_links) == 1 and not graph['nodes'][node]:
+            neighbor, direction = next(iter(node_links))
+            if neighbor != node:
+                leaves.setdefault((neighbor, direction), []).append(node)
+    replaced = {}
+    for (neighbor, direction), hosts in leaves.items():
+        if len(hosts) < 2:
+            continue
+        preposition = 'reached by' if direction == 'in' else 'reaching'
+        aggregate = f"{len(hosts)} hosts {preposition} {neighbor}"
+        for host in hosts:
+            replaced[host] = aggregate
+        graph['nodes'][aggregate] = {'members': sorted(hosts)}
+    if not replaced:
+        return graph
+    edges = []
+    seen = set()
+    for src, dst, options in graph['edges']:
+        src, dst = replaced.get(src, src), replaced.get(dst, dst)
+        if (src in graph['nodes'] and graph['nodes'][src].get('members')) or \
+                (dst in graph['nodes'] and graph['nodes'][dst].get('members')):
+            if (src, dst) in seen:
+                continue
+            seen.add((src, dst))
+        edges.append((src, dst, options))
+    nodes = {node: attrs for node, attrs in graph['nodes'].items() if node not in replaced}
+    return {'nodes': nodes, 'edges': edges}
+
+
+def apply_graph_limits(graph, limits):
+    # Large tailnets can produce maps no browser can open, so past the
+    # configured size leaf hosts are aggregated
+    max_nodes = limits.get('max_nodes', 2000)
+    max_edges = limits.get('max_edges', 10000)
+    if len(graph['nodes']) <= max_nodes and len(graph['edges']) <= max_edges:
+        return graph
+    before = (len(graph['nodes']), len(graph['edges']))
+    graph = aggregate_leaf_hosts(graph)
+    warn(f"The graph has {before[0]} nodes and {before[1]} edges, over the limit of {max_nodes} nodes / "
+         f"{max_edges} edges; leaf hosts were aggregated, leaving {len(graph['nodes'])} nodes and "
+         f"{len(graph['edges'])} edges. Use --include/--focus for detail.")
+    if len(graph['nodes']) > max_nodes or len(graph['edges']) > max_edges:
+        warn("The graph is still over the size limit after aggregation and may be slow to open")
+    return graph
+
+
+def render_graph(net, graph, settings):
+    for node, attrs in graph['nodes'].items():
+        add_policy_node(net, node, settings, attrs)
+    for src, dst, options in graph['edges']:
+        net.add_edge(src, dst, **options)
+
+
+def expand_group(group, groups, seen=None):
+    # Resolve nested groups into a flat set of members. autogroup: entries
+    # can't be expanded from the policy alone so they are kept as-is.
+    if seen is None:
+        seen = set()
+    if group in seen:
+        return set()
+    seen.add(group)
+    members = set()
+    for member in groups.get(group, []):
+        if member.startswith('group:'):
+            members |= expand_group(member, groups, seen)
+        else:
+            members.add(member)
+    return members
+
+
+def find_group_cycles(groups):
+    # Each cycle is returned once as a path that starts and ends on the same
+    # group, e.g. ['group:a', 'group:b', 'group:a']
+    cycles = []
+    seen_cycles = set()
+    finished = set()
+
+    def visit(group, path):
+        if group in path:
+            cycle = path[path.index(group):] + [group]
+            key = frozenset(cycle)
+            if key not in seen_cycles:
+                seen_cycles.add(key)
+                cycles.append(cycle)
+            return
+        if group in finished or group not in groups:
+            return
+        for member in groups[group] if isinstance(groups[group], list) else []:
+            if isinstance(member, str) and member.startswith('group:'):
+                visit(member, path + [group])
+        finished.add(group)
+
+    for group in groups:
+        visit(group, [])
+    return cycles
+
+
+def load_group_members_export(filename):
     if not os.path.isfile(filename):
-        print(f"Error: File '{filename}' not found.")
         return None
-
+    if filename.endswith('.csv'):
+        previous = {}
+        with open(filename, 'r', newline='') as f:
+            for row in csv.DictReader(f):
+                previous.setdefault(row['group'], set()).add(row['member'])
+        return previous
     with open(filename, 'r') as f:
-        # Try loading as JSON
+        return {group: set(members) for group, members in json.load(f).items()}
+
+
+def load_users(tailnet, config):
+    # The tailnet's users from the Tailscale API, or None if they can't be
+    # fetched
+    source = get_tailnet_api_url(tailnet, 'users')
+    text = read_policy_text(source, config)
+    if text is None:
+        return None
+    data = load_json_or_hujson_text(text, source)
+    users = data.get('users') if isinstance(data, dict) else None
+    if not isinstance(users, list) or not all(isinstance(user, dict) for user in users):
+        print(f"Error: '{source}' is not a Tailscale user list")
+        return None
+    return users
+
+
+def get_autogroup_users(autogroup, users):
+    # Login names of the users an autogroup stands for, or None for
+    # autogroups that aren't sets of users (tagged, self, internet, ...)
+    role = AUTOGROUP_USER_ROLES.get(autogroup)
+    user_type = {'autogroup:member': 'member', 'autogroup:shared': 'shared'}.get(autogroup)
+    if role is None and user_type is None:
+        return None
+    return {user['loginName'] for user in users
+            if user.get('loginName') and user.get('status') != 'suspended'
+            and (user.get('role') == role if role else user.get('type') == user_type)}
+
+
+def export_group_members(groups, filename, users=None):
+    members_by_group = {group: expand_group(group, groups) for group in groups}
+    if users is not None:
+        # With the tailnet's user list, role and membership autogroups are
+        # replaced by the users they currently stand for
+        for group, members in members_by_group.items():
+            for member in sorted(members):
+                expanded = get_autogroup_users(member, users) if member.startswith('autogroup:') else None
+                if expanded is not None:
+                    members.discard(member)
+                    members |= expanded
+
+    # Diff against the previous export so periodic reviews only need to look at what changed
+    previous = load_group_members_export(filename)
+    if previous is not None:
+        changed = False
+        for group in sorted(set(previous) | set(members_by_group)):
+            old = previous.get(group, set())
+            new = members_by_group.get(group, set())
+            for member in sorted(new - old):
+                print(f"+ {group}: {member}")
+                changed = True
+            for member in sorted(old - new):
+                print(f"- {group}: {member}")
+                changed = True
+        if not changed:
+            print(f"No group membership changes since the last export to '{filename}'")
+
+    if filename.endswith('.csv'):
+        with open(filename, 'w', newline='') as f:
+            writer = csv.writer(f)
+            writer.writerow(['group', 'member'])
+            for group in sorted(members_by_group):
+                for member in sorted(members_by_group[group]):
+                    writer.writerow([group, member])
+    else:
+        with open(filename, 'w') as f:
+            json.dump({group: sorted(members) for group, members in sorted(members_by_group.items())}, f, indent=2)
+            f.write("\n")
+    print(f"Exported members of {len(members_by_group)} groups to '{filename}'")
+
+
+def tokenize_hujson(text):
+    # Yields (kind, value, line, column) for the structural tokens of a
+    # JSON/HuJSON document: kind is 'punct' for {}[]:, 'string' for string
+    # literals and 'literal' for numbers, true/false/null. Comments and
+    # whitespace are skipped, so braces inside them don't throw callers off.
+    line = 1
+    line_start = 0
+    i = 0
+    while i < len(text):
+        c = text[i]
+        if c == '\n':
+            line += 1
+            line_start = i + 1
+            i += 1
+        elif c in ' \t\r\ufeff':
+            i += 1
+        elif c == '"':
+            end = i + 1
+            while end < len(text) and text[end] != '"':
+                if text[end] == '\\':
+                    end += 1
+                end += 1
+            yield 'string', text[i + 1:end], line, i - line_start + 1
+            if '\n' in text[i:end]:
+                line += text.count('\n', i, end)
+                line_start = text.rfind('\n', i, end) + 1
+            i = end + 1
+        elif text.startswith('//', i) or c == '#':
+            end = text.find('\n', i)
+            i = len(text) if end == -1 else end
+        elif text.startswith('/*', i):
+            end = text.find('*/', i)
+            end = len(text) if end == -1 else end + 2
+            if '\n' in text[i:end]:
+                line += text.count('\n', i, end)
+                line_start = text.rfind('\n', i, end) + 1
+            i = end
+        elif c in '{}[]:,':
+            yield 'punct', c, line, i - line_start + 1
+            i += 1
+        else:
+            end = i
+            while end < len(text) and text[end] not in '{}[]:,"\n \t\r/#':
+                end += 1
+            end = max(end, i + 1)
+            yield 'literal', text[i:end], line, i - line_start + 1
+            i = end
+
+
+def find_value_positions(text):
+    # The (line, column) where every value in the document starts, keyed by
+    # its path from the root, e.g. ('acls', 3) or ('groups', 'group:eng').
+    # Works on the tokens rather than the raw text, so rules on one line or
+    # braces inside comments don't matter.
+    if text in value_positions_cache:
+        return value_positions_cache[text]
+    positions = {}
+    stack = []  # one entry per open container: {'path', 'index' (None for objects), 'key'}
+    for kind, value, line, column in tokenize_hujson(text):
+        if kind == 'punct' and value in '}]':
+            if stack:
+                stack.pop()
+            continue
+        if kind == 'punct' and value in ':,':
+            if value == ',' and stack and stack[-1]['index'] is None:
+                stack[-1]['key'] = None
+            continue
+        if stack and stack[-1]['index'] is None and stack[-1]['key'] is None:
+            stack[-1]['key'] = value
+            continue
+        if not stack:
+            path = ()
+        elif stack[-1]['index'] is None:
+            path = stack[-1]['path'] + (stack[-1]['key'],)
+        else:
+            path = stack[-1]['path'] + (stack[-1]['index'],)
+            stack[-1]['index'] += 1
+        positions[path] = (line, column)
+        if kind == 'punct':
+            stack.append({'path': path, 'index': 0 if value == '[' else None, 'key': None})
+    value_positions_cache[text] = positions
+    return positions
+
+
+def find_rule_lines(text, section):
+    # Returns the (first line, last line) of every object in a top-level array
+    # such as "acls"
+    if (text, section) in rule_lines_cache:
+        return rule_lines_cache[(text, section)]
+    spans = []
+    stack = []
+    last_string = None
+    key = None
+    start = None
+    for kind, value, line, _ in tokenize_hujson(text):
+        if kind == 'string':
+            last_string = value
+        elif kind != 'punct':
+            continue
+        elif value == ':':
+            key = last_string
+        elif value in '{[':
+            if value == '[' and len(stack) == 1 and key == section:
+                stack.append('target')
+            else:
+                if value == '{' and stack and stack[-1] == 'target':
+                    start = line
+                stack.append(value)
+            key = None
+        elif value in '}]':
+            if stack:
+                opened = stack.pop()
+                if opened == '{' and stack and stack[-1] == 'target':
+                    spans.append((start, line))
+    rule_lines_cache[(text, section)] = spans
+    return spans
+
+
+def format_key_path(path):
+    # ['', 'acls', '[]'] -> 'acls[]'
+    formatted = ''
+    for part in path:
+        if part == '[]':
+            formatted += part
+        elif part:
+            formatted += ('.' if formatted else '') + part
+    return formatted
+
+
+def find_duplicate_keys(text):
+    # HuJSON lets the last of two identical keys win silently. Returns
+    # (path, key, first line, duplicate line) for every repeated key.
+    duplicates = []
+    # One entry per open container: {'keys': {key: line}, 'expect_key'} for
+    # objects, None for arrays. Keys are the token just before a ':' where a
+    # key is due, so unquoted HJSON keys count and values never do.
+    stack = []
+    path = []
+    previous = None
+    last_key = None
+    for kind, value, line, _ in tokenize_hujson(text):
+        top = stack[-1] if stack else None
+        if kind == 'punct' and value == ':':
+            if top is not None and top['expect_key'] and previous is not None and previous[0] != 'punct':
+                key, key_line = previous[1], previous[2]
+                if key in top['keys']:
+                    duplicates.append((format_key_path(path), key, top['keys'][key], key_line))
+                else:
+                    top['keys'][key] = key_line
+                top['expect_key'] = False
+                last_key = key
+        elif kind == 'punct' and value == ',':
+            if top is not None:
+                top['expect_key'] = True
+        elif kind == 'punct' and value in '{[':
+            if not stack:
+                path.append('')
+            else:
+                path.append(last_key if top is not None else '[]')
+            stack.append({'keys': {}, 'expect_key': True} if value == '{' else None)
+            last_key = None
+        elif kind == 'punct' and value in '}]':
+            if stack:
+                stack.pop()
+                path.pop()
+            if stack and stack[-1] is not None:
+                # HJSON doesn't need commas between members
+                stack[-1]['expect_key'] = True
+        elif top is not None and not top['expect_key']:
+            top['expect_key'] = True
+        previous = (kind, value, line)
+    return duplicates
+
+
+def partition_target(target):
+    # Splits at the last colon, like Tailscale, so "fd7a:115c::1:22" is port 22
+    # of fd7a:115c::1. The bracketed "[fd7a:115c::1]:22" is accepted too.
+    if target.startswith('[') and ']:' in target:
+        base, _, ports = target[1:].partition(']:')
+        return base, ':', ports
+    return target.rpartition(':')
+
+
+def split_target(target):
+    # "tag:web:80,443" -> ("tag:web", "80,443"); "*:*" -> ("*", "*");
+    # "fd7a:115c::/48:*" -> ("fd7a:115c::/48", "*")
+    base, sep, ports = partition_target(target)
+    if sep and base and re.fullmatch(r"[\d,*-]+", ports):
+        return base, ports
+    return target, '*'
+
+
+def parse_ports(spec):
+    ranges = []
+    for part in spec.split(','):
+        part = part.strip()
+        if part == '*':
+            ranges.append((0, 65535))
+        elif '-' in part:
+            lo, hi = part.split('-', 1)
+            ranges.append((int(lo), int(hi)))
+        elif part:
+            ranges.append((int(part), int(part)))
+    return ranges
+
+
+def subtract_ranges(ranges, covering):
+    remaining = list(ranges)
+    for c_lo, c_hi in covering:
+        next_remaining = []
+        for lo, hi in remaining:
+            if c_hi < lo or c_lo > hi:
+                next_remaining.append((lo, hi))
+                continue
+            if lo < c_lo:
+                next_remaining.append((lo, c_lo - 1))
+            if hi > c_hi:
+                next_remaining.append((c_hi + 1, hi))
+        remaining = next_remaining
+    return remaining
+
+
+def format_ports(ranges):
+    if ranges == [(0, 65535)]:
+        return '*'
+    return ','.join(str(lo) if lo == hi else f"{lo}-{hi}" for lo, hi in ranges)
+
+
+def expand_source(src, groups):
+    if src.startswith('group:'):
+        return expand_group(src, groups) or {src}
+    return {src}
+
+
+def rule_access_pairs(rule, groups, hosts):
+    # Effective (source, destination) -> port ranges granted by one ACL rule,
+    # with groups expanded to their members and host names resolved to addresses
+    pairs = {}
+    sources = set()
+    for src in rule.get('src', []):
+        sources |= expand_source(src, groups)
+    for target in rule.get('dst', []):
+        base, ports = split_target(target)
+        dst = hosts.get(base, base)
+        for src in sources:
+            pairs.setdefault((src, dst), []).extend(parse_ports(ports))
+    return pairs
+
+
+def grant_access_pairs(grant, groups, hosts):
+    # Like rule_access_pairs for a grant, keyed by (source, destination,
+    # protocol number) with None standing for every protocol
+    pairs = {}
+    sources = set()
+    for src in grant.get('src', []):
+        sources |= expand_source(src, groups)
+    for target in grant.get('dst', []):
+        dst = hosts.get(target, target)
+        for entry in grant.get('ip', []):
+            _, number, ports = parse_grant_ip(entry)
+            for src in sources:
+                pairs.setdefault((src, dst, number), []).extend(parse_ports(ports))
+    return pairs
+
+
+def find_redundant_acls(acls, grants, groups, hosts, default_posture=()):
+    # ACL rules whose access is entirely granted by grants as well, which
+    # is common halfway through migrating to grants. Returns
+    # (ACL index, indexes of the covering grants). Grants through via
+    # routers don't count, and neither do grants requiring a posture the
+    # ACL rule doesn't (rules without srcPosture get default_posture).
+    def posture(rule):
+        return set(rule.get('srcPosture') or default_posture)
+
+    grant_pairs = [(i, grant_access_pairs(grant, groups, hosts), posture(grant))
+                   for i, grant in enumerate(grants) if not grant.get('via')]
+    redundant = []
+    for index, rule in enumerate(acls):
+        protos = [number for _, number in resolve_protocols(rule['proto'])] if 'proto' in rule else [None]
+        rule_posture = posture(rule)
+        covered_by = set()
+        for (src, dst), ranges in rule_access_pairs(rule, groups, hosts).items():
+            for proto in protos:
+                remaining = ranges
+                for i, pairs, grant_posture in grant_pairs:
+                    if grant_posture - rule_posture:
+                        continue
+                    for (grant_src, grant_dst, grant_proto), grant_ranges in pairs.items():
+                        if grant_src in (src, '*') and grant_dst in (dst, '*') and grant_proto in (proto, None):
+                            narrowed = subtract_ranges(remaining, grant_ranges)
+                            if narrowed != remaining:
+                                covered_by.add(i)
+                            remaining = narrowed
+                if remaining:
+                    break
+            if remaining:
+                break
+        else:
+            if covered_by:
+                redundant.append((index, sorted(covered_by)))
+    return redundant
+
+
+def covers_target(broad, narrow):
+    # Whether access to broad includes narrow: the same target, "*", or a
+    # CIDR containing the address or network
+    if broad in (narrow, '*'):
+        return True
+    try:
+        broad_networks = parse_host_value(broad)
+        return all(any(n.version == b.version and n.subnet_of(b) for b in broad_networks)
+                   for n in parse_host_value(narrow))
+    except ValueError:
+        return False
+
+
+def acl_access_pairs(rule, groups, hosts):
+    # rule_access_pairs keyed like grant_access_pairs, by (source,
+    # destination, protocol number) with None standing for every protocol
+    protos = [number for _, number in resolve_protocols(rule['proto'])] if 'proto' in rule else [None]
+    return {(src, dst, proto): ranges
+            for (src, dst), ranges in rule_access_pairs(rule, groups, hosts).items() for proto in protos}
+
+
+def access_covers(broad_pairs, narrow_pairs):
+    for (src, dst, proto), ranges in narrow_pairs.items():
+        remaining = ranges
+        for (broad_src, broad_dst, broad_proto), broad_ranges in broad_pairs.items():
+            if broad_src in (src, '*') and broad_proto in (proto, None) and covers_target(broad_dst, dst):
+                remaining = subtract_ranges(remaining, broad_ranges)
+        if remaining:
+            return False
+    return True
+
+
+def find_shadowed_rules(acls, grants, groups, hosts):
+    # Rules whose access a single earlier rule of the same kind already
+    # gives in full. Returns (section, index, earlier index, duplicate), where
+    # duplicate means both rules give exactly the same access. Grants with
+    # app capabilities or via routers do more than open ports and are left out.
+    shadowed = []
+    for section, rules, get_pairs in (('acls', acls, acl_access_pairs), ('grants', grants, grant_access_pairs)):
+        earlier_rules = []
+        for index, rule in enumerate(rules):
+            if rule.get('via'):
+                continue
+            pairs = get_pairs(rule, groups, hosts)
+            posture = set(rule.get('srcPosture', []))
+            if pairs and not rule.get('app'):
+                for earlier, earlier_pairs, earlier_posture in earlier_rules:
+                    if earlier_posture - posture or not access_covers(earlier_pairs, pairs):
+                        continue
+                    duplicate = earlier_posture == posture and access_covers(pairs, earlier_pairs)
+                    shadowed.append((section, index, earlier, duplicate))
+                    break
+            earlier_rules.append((index, pairs, posture))
+    return shadowed
+
+
+def remove_rules_from_text(text, section, positions):
+    # Drops the lines of the given rules (by position in the section) from
+    # the policy text, leaving comments and formatting alone. Rules that share
+    # a line with something else are left in place and returned.
+    lines = text.splitlines(keepends=True)
+    spans = find_rule_lines(text, section)
+    # How many rules start or end on each line
+    rule_ends = {}
+    for first, last in spans:
+        for line in {first, last}:
+            rule_ends[line] = rule_ends.get(line, 0) + 1
+    drop = set()
+    kept = []
+    for position in positions:
+        first, last = spans[position]
+        if rule_ends[first] > 1 or rule_ends[last] > 1 or not lines[first - 1].lstrip().startswith('{') or \
+                not lines[last - 1].rstrip().rstrip(',').endswith('}'):
+            kept.append(position)
+            continue
+        drop.update(range(first - 1, last))
+    return "".join(line for number, line in enumerate(lines) if number not in drop), kept
+
+
+def write_without_redundant_acls(filename, redundant_acls, main_source, sources, provenance):
+    positions = []
+    for index, _ in redundant_acls:
+        origin, position = provenance['acls'][index]
+        if origin != main_source:
+            warn(f"ACL rule #{index} is in imported file '{origin}'; remove it there by hand")
+            continue
+        positions.append(position)
+    text, kept = remove_rules_from_text(sources[main_source], 'acls', positions)
+    for position in kept:
+        warn(f"ACL rule at line {find_rule_lines(sources[main_source], 'acls')[position][0]} shares a line "
+             f"with other content and was left in place")
+    with open(filename, 'w') as f:
+        f.write(text)
+    print(f"Removed {len(positions) - len(kept)} redundant ACL rule(s), wrote {filename}")
+
+
+def convert_acl_to_grants(rule):
+    # The grants equivalent to a validated ACL rule, and notes on anything
+    # that needs a closer look. A grant's ip list applies to all of its
+    # destinations, so destinations with different ports become separate
+    # grants.
+    notes = []
+    by_ports = {}
+    for target in rule['dst']:
+        base, ports = split_target(target)
+        by_ports.setdefault(ports, []).append(base)
+        if not target.startswith('[') and '/' not in base and ':' in base and is_ip_address(base):
+            notes.append(f"dst '{target}' was read as port {ports} of {base}; "
+                         f"check it wasn't meant as an address with no port")
+    if len(by_ports) > 1:
+        notes.append(f"destinations have different ports ({', '.join(by_ports)}), "
+                     f"so the rule was split into {len(by_ports)} grants")
+    protos = resolve_protocols(rule['proto']) if 'proto' in rule else []
+    if protos:
+        # Grants name tcp, udp and icmp; anything else is safest as its number
+        names = [name if name in ('tcp', 'udp', 'icmp') else str(number) for name, number in protos]
+        notes.append(f"proto {json.dumps(rule['proto'])} was moved into ip as {', '.join(names)}; "
+                     f"check the ports still make sense for it")
+    for field in sorted(set(rule) - {'action', 'src', 'dst', 'proto', 'srcPosture'}):
+        notes.append(f"field '{field}' has no grant equivalent and was dropped")
+    grants = []
+    for ports, targets in by_ports.items():
+        grant = {'src': list(rule['src']), 'dst': targets,
+                 'ip': [f"{name}:{ports}" for name in names] if protos else [ports]}
+        if 'srcPosture' in rule:
+            grant['srcPosture'] = list(rule['srcPosture'])
+        grants.append(grant)
+    return grants, notes
+
+
+def write_grants_conversion(filename, acls, sources, provenance):
+    # Proposed grants for every ACL rule as HuJSON, each under a comment
+    # saying which rule it came from and what to check
+    lines = ['{', '  "grants": [']
+    converted = 0
+    flagged = 0
+    for index, rule in enumerate(acls):
+        grants, notes = convert_acl_to_grants(rule)
+        location = get_rule_location('acls', index, sources, provenance)
+        where = f" ({location[0]}, line {location[1]})" if location else ""
+        lines.append(f"    // From ACL rule #{index}{where}")
+        for note in notes:
+            lines.append(f"    // CHECK: {note}")
+            warn(f"ACL rule #{index}{where}: {note}")
+        lines += [f"    {json.dumps(grant)}," for grant in grants]
+        converted += len(grants)
+        flagged += 1 if notes else 0
+    lines += ['  ],', '}', '']
+    with open(filename, 'w') as f:
+        f.write('\n'.join(lines))
+    print(f"Converted {len(acls)} ACL rule(s) into {converted} grant(s), {flagged} need a closer look; wrote {filename}")
+
+
+def rule_removal_impact(acls, index, groups, hosts, grants=(), default_posture=()):
+    # Access pairs that only the given rule grants would disappear if it were
+    # removed; the rest are still granted by another ACL rule or a grant.
+    # Pairs are (source, destination, protocol number or None for every
+    # protocol), and like find_redundant_acls a rule only counts if it covers
+    # the protocol and needs no posture the removed rule doesn't.
+    def posture(rule):
+        return set(rule.get('srcPosture') or default_posture)
+
+    rule_posture = posture(acls[index])
+    removed = acl_access_pairs(acls[index], groups, hosts)
+    others = [(f"rule #{i}", acl_access_pairs(rule, groups, hosts)) for i, rule in enumerate(acls)
+              if i != index and rule.get('action') == 'accept' and not posture(rule) - rule_posture]
+    others += [(f"grant #{i}", grant_access_pairs(grant, groups, hosts)) for i, grant in enumerate(grants)
+               if not grant.get('via') and not posture(grant) - rule_posture]
+    lost = []
+    covered = []
+    for (src, dst, proto), ranges in sorted(removed.items(), key=lambda item: (item[0][:2], item[0][2] or 0)):
+        remaining = ranges
+        covered_by = []
+        for label, pairs in others:
+            for (other_src, other_dst, other_proto), other_ranges in pairs.items():
+                if other_src in (src, '*') and other_proto in (proto, None) and covers_target(other_dst, dst):
+                    narrowed = subtract_ranges(remaining, other_ranges)
+                    if narrowed != remaining and label not in covered_by:
+                        covered_by.append(label)
+                    remaining = narrowed
+        if remaining:
+            lost.append((src, dst, proto, remaining))
+        if covered_by:
+            covered.append((src, dst, proto, covered_by))
+    return lost, covered
+
+
+def test_source_identities(src, groups):
+    # Everything a test's source can be matched as in a rule's src
+    identities = {src, '*'}
+    identities |= {group for group in groups if src in expand_group(group, groups)}
+    if '@' in src:
+        identities.add('autogroup:member')
+    return identities
+
+
+def target_matches(rule_target, target, hosts):
+    # Whether a rule destination (without ports) covers a test destination,
+    # resolving host names and checking addresses against CIDRs
+    if rule_target == '*':
+        return True
+    rule_address = hosts.get(rule_target, rule_target)
+    address = hosts.get(target, target)
+    if rule_address == address:
+        return True
+    try:
+        address = ipaddress.ip_address(address.split(',')[0].strip().split('/')[0])
+        return any(address in network for network in parse_host_value(rule_address))
+    except ValueError:
+        return False
+
+
+def find_allowing_rule(src, target, proto, acls, grants, groups, hosts):
+    # The first ACL rule or grant that lets src reach target ("tag:web:443")
+    # over proto (a protocol number), or None
+    identities = test_source_identities(src, groups)
+    base, port = split_target(target)
+    port = 0 if port == '*' else int(port)
+    for index, rule in enumerate(acls):
+        if not identities & set(rule['src']):
+            continue
+        if 'proto' in rule and proto not in [number for _, number in resolve_protocols(rule['proto'])]:
+            continue
+        for dst in rule['dst']:
+            dst_base, ports = split_target(dst)
+            if dst_base != 'autogroup:self' and target_matches(dst_base, base, hosts) and \
+                    any(lo <= port <= hi for lo, hi in parse_ports(ports)):
+                return f"ACL rule #{index}"
+    for index, grant in enumerate(grants):
+        if not identities & set(grant['src']) or not any(target_matches(dst, base, hosts) for dst in grant['dst']):
+            continue
+        for entry in grant.get('ip', []):
+            _, number, ports = parse_grant_ip(entry)
+            if number in (None, proto) and any(lo <= port <= hi for lo, hi in parse_ports(ports)):
+                return f"grant #{index}"
+    return None
+
+
+def find_ssh_rule(src, dst, user, ssh_rules, groups, hosts):
+    # The action ("accept" or "check") and index of the first SSH rule that
+    # lets src log in to dst as user, or (None, None)
+    identities = test_source_identities(src, groups)
+    for index, rule in enumerate(ssh_rules):
+        if not identities & set(rule['src']) or not any(target_matches(d, dst, hosts) for d in rule['dst']):
+            continue
+        if user in rule['users'] or (user != 'root' and 'autogroup:nonroot' in rule['users']):
+            return rule['action'], index
+    return None, None
+
+
+def validate_policy_test(test, section):
+    # Problems that would stop an entry of "tests" or "sshTests" from being
+    # evaluated. Test destinations need a single port, like in Tailscale.
+    if not isinstance(test, dict):
+        return ["test is not an object"]
+    problems = []
+    if not isinstance(test.get('src'), str) or not test['src']:
+        problems.append("src must be a non-empty string")
+    expectations = ('accept', 'deny') if section == 'tests' else ('accept', 'check', 'deny')
+    for field in expectations + (('dst',) if section == 'sshTests' else ()):
+        value = test.get(field, [])
+        if not isinstance(value, list) or not all(isinstance(entry, str) for entry in value):
+            problems.append(f"{field} must be a list of strings")
+        elif section == 'tests':
+            for target in value:
+                port = split_target(target)[1]
+                if port != '*' and not port.isdigit():
+                    problems.append(f"{field} '{target}' must name a single port")
+    if section == 'tests' and 'proto' in test:
         try:
-            data = json.load(f)
-            return data
+            resolve_protocol(test['proto'])
+        except ValueError as e:
+            problems.append(str(e))
+    return problems
+
+
+def run_policy_tests(policy, acls, grants, ssh_rules, groups, hosts, sources, provenance):
+    # Evaluates the policy's "tests" and "sshTests" against the parsed rules.
+    # Returns (location, passed, message) for every accept/deny/check entry;
+    # a test that can't be evaluated is one failure with its problems.
+    results = []
+    for section in ('tests', 'sshTests'):
+        if not isinstance(policy.get(section, []), list):
+            results.append((section, False, f"{section} must be a list"))
+    tests = policy.get('tests', []) if isinstance(policy.get('tests', []), list) else []
+    ssh_tests = policy.get('sshTests', []) if isinstance(policy.get('sshTests', []), list) else []
+    for index, test in enumerate(tests):
+        location = get_rule_location('tests', index, sources, provenance)
+        where = f"{location[0]}:{location[1]}" if location else f"tests #{index}"
+        problems = validate_policy_test(test, 'tests')
+        if problems:
+            results.append((where, False, "; ".join(problems)))
+            continue
+        src = test['src']
+        proto = resolve_protocol(test['proto'])[1] if 'proto' in test else 6
+        for expected in ('accept', 'deny'):
+            for target in test.get(expected, []):
+                allowed_by = find_allowing_rule(src, target, proto, acls, grants, groups, hosts)
+                passed = (allowed_by is not None) == (expected == 'accept')
+                outcome = f"allowed by {allowed_by}" if allowed_by else "not allowed by any rule"
+                results.append((where, passed, f"{src} -> {target} should be {TEST_EXPECTATIONS[expected]}, {outcome}"))
+    for index, test in enumerate(ssh_tests):
+        location = get_rule_location('sshTests', index, sources, provenance)
+        where = f"{location[0]}:{location[1]}" if location else f"sshTests #{index}"
+        problems = validate_policy_test(test, 'sshTests')
+        if problems:
+            results.append((where, False, "; ".join(problems)))
+            continue
+        src = test['src']
+        for dst in test.get('dst', []):
+            for expected in ('accept', 'check', 'deny'):
+                for user in test.get(expected, []):
+                    action, rule_index = find_ssh_rule(src, dst, user, ssh_rules, groups, hosts)
+                    passed = action == expected or (action is None and expected == 'deny')
+                    outcome = f"{action}ed by SSH rule #{rule_index}" if action else "not allowed by any SSH rule"
+                    results.append((where, passed,
+                                    f"{src} -> {user}@{dst} should be {TEST_EXPECTATIONS[expected]}, {outcome}"))
+    return results
+
+
+def get_rule_location(section, index, sources, provenance):
+    # Returns (file, line, column) of a rule in the merged list
+    origins = provenance.get(section, [])
+    if index >= len(origins):
+        return None
+    origin, position = origins[index]
+    found = find_value_positions(sources[origin]).get((section, position))
+    return (origin, *found) if found else None
+
+
+def get_definition_location(section, key, sources, provenance):
+    # Returns (file, line, column) of a group, host, tag owner or ipset
+    origin = provenance.get(section, {}).get(key)
+    if origin is None:
+        return None
+    found = find_value_positions(sources[origin]).get((section, key))
+    return (origin, *found) if found else None
+
+
+def add_definition_locations(graph, sources, provenance):
+    # Groups, hosts, tags and ipsets show where they are defined in their
+    # tooltip
+    for node, attrs in graph['nodes'].items():
+        section = {'group': 'groups', 'host': 'hosts', 'network': 'hosts', 'tag': 'tagOwners',
+                   'ipset': 'ipsets'}.get(get_node_type(node))
+        if section:
+            location = get_definition_location(section, node, sources, provenance)
+            if location:
+                attrs['defined_at'] = location
+
+
+def parse_rule_spec(value):
+    # --remove-rule: "3" -> ('index', 3), "line:42" -> ('line', 42)
+    kind, number = ('line', value[len('line:'):]) if value.startswith('line:') else ('index', value)
+    if not number.isdigit() or (kind == 'line' and int(number) == 0):
+        raise argparse.ArgumentTypeError(f"'{value}' is not a rule index (0, 1, ...) or line:N with N >= 1")
+    return kind, int(number)
+
+
+def print_rule_removal_impact(acl_file_path, acls, grants, rule_spec, groups, hosts, default_posture, sources, provenance):
+    kind, number = rule_spec
+    if kind == 'line':
+        line = number
+        rule_lines = find_rule_lines(sources[acl_file_path], 'acls')
+        matches = [i for i, (first, last) in enumerate(rule_lines) if first <= line <= last]
+        # Positions are in the file; skipped and imported rules shift the
+        # merged list
+        origins = provenance.get('acls', [])
+        if not matches or (acl_file_path, matches[0]) not in origins:
+            print(f"Error: No ACL rule found at line {line}")
+            exit(1)
+        index = origins.index((acl_file_path, matches[0]))
+    else:
+        index = number
+        if index >= len(acls):
+            print(f"Error: Rule index {index} is out of range (the policy has {len(acls)} ACL rules)")
+            exit(1)
+
+    rule = acls[index]
+    location = get_rule_location('acls', index, sources, provenance)
+    if location is None:
+        location = ""
+    elif location[0] == acl_file_path:
+        location = f" (line {location[1]})"
+    else:
+        location = f" ({location[0]}, line {location[1]})"
+    print(f"Removing ACL rule #{index}{location}: {', '.join(rule['src'])} -> {', '.join(rule['dst'])}")
+
+    def proto_label(proto):
+        return "" if proto is None else f" ({resolve_protocol(str(proto))[0]})"
+
+    lost, covered = rule_removal_impact(acls, index, groups, hosts, grants, default_posture)
+    if lost:
+        print("Access that would be removed:")
+        for src, dst, proto, ranges in lost:
+            print(f"  {src} -> {dst}:{format_ports(ranges)}{proto_label(proto)}")
+    else:
+        print("No access would be removed; every pair is also granted by another rule or grant.")
+    if covered:
+        print("Access still granted by other rules:")
+        for src, dst, proto, labels in covered:
+            print(f"  {src} -> {dst}{proto_label(proto)} ({', '.join(labels)})")
+
+
+def export_drawio(net, filename):
+    # Lay nodes out in columns (groups/users, tags, hosts) so the diagram is
+    # readable as soon as it's opened; draw.io has no physics layout of its own
+    columns = {'group': 0, 'tag': 1, 'host': 2, 'ipset': 2, 'network': 2, 'derp': 3}
+    next_row = {column: 0 for column in columns.values()}
+    node_width, node_height = 180, 40
+
+    mxfile = ET.Element('mxfile', host='tailscale-network-topology-mapper')
+    diagram = ET.SubElement(mxfile, 'diagram', name='Network Topology', id='network-topology')
+    model = ET.SubElement(diagram, 'mxGraphModel', grid='1', gridSize='10', arrows='1', page='0')
+    root = ET.SubElement(model, 'root')
+    ET.SubElement(root, 'mxCell', id='0')
+    ET.SubElement(root, 'mxCell', id='1', parent='0')
+
+    cell_ids = {}
+    for i, node in enumerate(net.nodes):
+        cell_ids[node['id']] = f"node-{i}"
+        column = columns[get_node_type(node['id'])]
+        row = next_row[column]
+        next_row[column] += 1
+        style = f"rounded=1;whiteSpace=wrap;html=1;fillColor={node.get('color', node_colors['host'])};"
+        cell = ET.SubElement(root, 'mxCell', id=cell_ids[node['id']], value=str(node['id']),
+                             style=style, vertex='1', parent='1')
+        ET.SubElement(cell, 'mxGeometry', x=str(column * 400), y=str(row * (node_height + 30)),
+                      width=str(node_width), height=str(node_height), attrib={'as': 'geometry'})
+
+    for i, edge in enumerate(net.edges):
+        style = "endArrow=classic;html=1;rounded=0;"
+        if edge.get('color'):
+            style += f"strokeColor={edge['color']};"
+        if edge.get('dashes'):
+            style += "dashed=1;"
+        cell = ET.SubElement(root, 'mxCell', id=f"edge-{i}", value=edge.get('title', ''), style=style, edge='1',
+                             parent='1', source=cell_ids[edge['from']], target=cell_ids[edge['to']])
+        ET.SubElement(cell, 'mxGeometry', relative='1', attrib={'as': 'geometry'})
+
+    tree = ET.ElementTree(mxfile)
+    ET.indent(tree)
+    tree.write(filename, encoding='utf-8', xml_declaration=True)
+    print(f"Exported draw.io diagram to '{filename}'")
+
+
+def rule_matches_collection(rule, collection, location, main_source):
+    if 'lines' in collection:
+        if location is None or location[0] != main_source:
+            return False
+        if not any(first <= location[1] <= last for first, last in collection['lines']):
+            return False
+    if 'src' in collection:
+        if not any(fnmatch.fnmatch(src, pattern) for src in rule.get('src', []) for pattern in collection['src']):
+            return False
+    if 'dst' in collection:
+        targets = [t for dst in rule.get('dst', []) for t in (dst, split_target(dst)[0])]
+        if not any(fnmatch.fnmatch(t, pattern) for t in targets for pattern in collection['dst']):
+            return False
+    return any(key in collection for key in ('lines', 'src', 'dst'))
+
+
+def get_rule_annotation_lines(section, index, sources, provenance, source_lines):
+    # The lines of a rule plus the comments directly above it, i.e. everything
+    # after the end of the previous rule (or the start of the section). Rules
+    # are found by their position in the file, so several rules on one line
+    # each get that line. source_lines has the lines of every file.
+    origin, position = provenance[section][index]
+    spans = find_rule_lines(sources[origin], section)
+    lines = source_lines[origin]
+    if position >= len(spans):
+        return []
+    first_line, last_line = spans[position]
+    if position > 0:
+        comment_start = spans[position - 1][1]
+    else:
+        comment_start = find_value_positions(sources[origin])[(section,)][0] - 1
+    return lines[min(comment_start, first_line - 1):last_line]
+
+
+def get_rule_collections(rules_by_section, collections_config, main_source, sources, provenance):
+    # A rule belongs to the collection named in a "// collection: NAME" comment
+    # directly above (or inside) it, otherwise to the first collection from the
+    # config whose line ranges and src/dst patterns all match it. Returns the
+    # names (or None) for every rule, by section.
+    source_lines = {source: text.splitlines() for source, text in sources.items()}
+    rule_collections = {}
+    for section, rules in rules_by_section.items():
+        rule_collections[section] = []
+        for index, rule in enumerate(rules):
+            location = get_rule_location(section, index, sources, provenance)
+            name = None
+            for line in get_rule_annotation_lines(section, index, sources, provenance, source_lines):
+                match = COLLECTION_ANNOTATION_PATTERN.search(line)
+                if match:
+                    name = match.group(1)
+            if name is None:
+                for collection_name, collection in collections_config.items():
+                    if rule_matches_collection(rule, collection, location, main_source):
+                        name = collection_name
+                        break
+            rule_collections[section].append(name)
+    return rule_collections
+
+
+def get_rule_expiries(rules_by_section, sources, provenance):
+    # The date from a "// expires: YYYY-MM-DD" comment above (or inside) each
+    # rule, or None, by section
+    source_lines = {source: text.splitlines() for source, text in sources.items()}
+    expiries = {}
+    for section, rules in rules_by_section.items():
+        expiries[section] = []
+        for index in range(len(rules)):
+            expires = None
+            for line in get_rule_annotation_lines(section, index, sources, provenance, source_lines):
+                match = EXPIRY_ANNOTATION_PATTERN.search(line)
+                if not match:
+                    continue
+                try:
+                    expires = date.fromisoformat(match.group(1))
+                except ValueError:
+                    location = get_rule_location(section, index, sources, provenance)
+                    warn(f"{ANNOTATED_SECTIONS[section]} #{index} ({location[0]}, line {location[1]}) has an invalid "
+                         f"expiry date '{match.group(1)}', expected YYYY-MM-DD")
+            expiries[section].append(expires)
+    return expiries
+
+
+def check_rule_expiries(expiries, sources, provenance, warn_days):
+    # Warns about expired rules and returns the rules expiring within
+    # warn_days as (description, date) for the run summary and audit log
+    today = date.today()
+    upcoming = []
+    for section, section_expiries in expiries.items():
+        for index, expires in enumerate(section_expiries):
+            if expires is None:
+                continue
+            location = get_rule_location(section, index, sources, provenance)
+            description = f"{ANNOTATED_SECTIONS[section]} #{index} ({location[0]}, line {location[1]})"
+            if expires < today:
+                warn(f"{description} expired on {expires.isoformat()} and should be removed")
+            elif (expires - today).days <= warn_days:
+                upcoming.append((description, expires))
+    return upcoming
+
+
+def assign_node_collections(net, rules_by_section, rule_collections):
+    # vis.js clusters can't share nodes, so a node joins the first collection
+    # that uses it. ACLs are passed merged, so their nodes are named like the
+    # graph's.
+    node_collections = {}
+    for section, rules in rules_by_section.items():
+        for rule, name in zip(rules, rule_collections[section]):
+            if name is None:
+                continue
+            for node in list(rule['src']) + list(rule['dst']):
+                node_collections.setdefault(node, name)
+    for node in net.nodes:
+        if node['id'] in node_collections:
+            node['collection'] = node_collections[node['id']]
+    return sorted(set(node_collections.values()))
+
+
+def apply_layout_pins(net, pins, settings):
+    # "x"/"y" pins fix a node in place. "level" pins only mean something in
+    # the hierarchical layout, where vis.js needs every node to have a level,
+    # so the rest get one from their type (groups, then tags, then hosts by
+    # default). A "mass" per type spreads heavy types apart in physics mode.
+    hierarchical = settings['layout'] == 'hierarchical'
+    if hierarchical:
+        net.options.layout.hierarchical.direction = settings['direction']
+    nodes = {node['id']: node for node in net.nodes}
+    for node_id in pins:
+        if node_id not in nodes:
+            warn(f"Pinned node '{node_id}' is not in the graph")
+
+    node_types = settings['node_types']
+    for node_id, node in nodes.items():
+        pin = pins.get(node_id, {})
+        type_options = node_types.get(get_node_type(node_id), {})
+        if 'x' in pin and 'y' in pin:
+            node['x'] = pin['x']
+            node['y'] = pin['y']
+            node['fixed'] = {'x': True, 'y': True}
+        if hierarchical:
+            node['level'] = pin.get('level', type_options.get('level', 0))
+        if 'mass' in type_options:
+            node['mass'] = type_options['mass']
+
+
+def build_controls_html(collection_names, focus, depth):
+    # Panel in the bottom left with the focus control and, when there are any,
+    # the rule collections
+    controls_html = f"""
+<div style="position: absolute; bottom: 10px; left: 10px; background-color: #f5f5f5; padding: 10px; border: 1px solid #ccc;">
+    <h3>Focus</h3>
+    <input id="focus-node" type="text" placeholder="tag:prod" value="{html.escape(focus or '')}">
+    <input id="focus-depth" type="number" min="0" style="width: 3em;" value="{depth}">
+    <button onclick="focusNode(document.getElementById('focus-node').value, parseInt(document.getElementById('focus-depth').value, 10))">Focus</button>
+    <button onclick="focusNode('', 0)">Show all</button>
+"""
+    if collection_names:
+        controls_html += "    <h3>Rule collections</h3>\n" + "\n".join(
+            f'    <button style="display: block; margin: 2px 0;" onclick="toggleCollection({html.escape(json.dumps(name))})">{html.escape(name)}</button>'
+            for name in collection_names) + "\n"
+    controls_html += """</div>
+<script>
+function focusNode(nodeId, depth) {
+    // Hides everything more than `depth` hops away from nodeId; an empty id shows all nodes again
+    var keep = {};
+    if (nodeId) {
+        keep[nodeId] = true;
+        var frontier = [nodeId];
+        for (var d = 0; d < depth; d++) {
+            var next = [];
+            frontier.forEach(function (n) {
+                network.getConnectedNodes(n).forEach(function (m) {
+                    if (!keep[m]) {
+                        keep[m] = true;
+                        next.push(m);
+                    }
+                });
+            });
+            frontier = next;
+        }
+    }
+    nodes.update(nodes.get().map(function (n) {
+        return {id: n.id, hidden: nodeId ? !keep[n.id] : false};
+    }));
+}
+function toggleCollection(name) {
+    var clusterId = "collection:" + name;
+    if (network.isCluster(clusterId)) {
+        network.openCluster(clusterId);
+        return;
+    }
+    network.cluster({
+        joinCondition: function (node) { return node.collection === name; },
+        clusterNodeProperties: {id: clusterId, label: name, shape: "box", borderWidth: 3, color: "#dddddd"}
+    });
+}
+network.on("doubleClick", function (params) {
+    if (params.nodes.length === 1 && network.isCluster(params.nodes[0])) {
+        network.openCluster(params.nodes[0]);
+    }
+});
+"""
+    # Collections start collapsed
+    controls_html += "\n".join(f"toggleCollection({json.dumps(name)});" for name in collection_names)
+    controls_html += "\n</script>\n"
+    return controls_html
+
+
+def get_rule_table_rows(acls, merged_acls, grants, ssh_rules, summaries, sources, provenance):
+    # One row per ACL rule and grant, with the graph edges it produces so the
+    # table and the graph can highlight each other (autogroup:self is a loop)
+    rows = []
+    for section, rules in (('acls', acls), ('grants', grants), ('ssh', ssh_rules)):
+        for index, rule in enumerate(rules):
+            location = get_rule_location(section, index, sources, provenance)
+            if section == 'acls':
+                merged = merged_acls[index]
+                ports = sorted({split_target(dst)[1] for dst in rule['dst']})
+                if 'proto' in merged:
+                    ports = [f"{name}:{p}" for name, _ in merged['proto'] for p in ports]
+                edges = [[src, src if dst == 'autogroup:self' else dst] for src in merged['src'] for dst in merged['dst']]
+            elif section == 'grants':
+                ports = list(rule.get('ip', [])) + [f"app {app}" for app in rule.get('app', {})]
+                edges = [[src, src if dst == 'autogroup:self' else dst] for src in rule['src'] for dst in rule['dst']]
+            else:
+                ports = [f"ssh as {', '.join(rule['users'])}" + (" (check)" if rule['action'] == 'check' else "")]
+                edges = [[src, src if dst == 'autogroup:self' else dst] for src in rule['src'] for dst in rule['dst']]
+            rows.append({
+                'type': {'acls': "ACL", 'grants': "Grant", 'ssh': "SSH"}[section],
+                'index': index,
+                'src': ", ".join(rule['src']),
+                'dst': ", ".join(rule['dst']),
+                'ports': ", ".join(ports),
+                'summary': summaries[section][index],
+                'location': f"{location[0]}:{location[1]}" if location else "",
+                'edges': edges,
+            })
+    return rows
+
+
+def build_rules_table_html(rows):
+    # Sortable, filterable table of every rule below the graph. Hovering a row
+    # highlights its edges; selecting an edge highlights the rules behind it.
+    rows_json = json.dumps(rows).replace("</", "<\\/")
+    return """
+<div style="margin: 10px; font-family: sans-serif; font-size: 13px;">
+    <h3>Rules</h3>
+    <input id="rule-filter" type="text" placeholder="Filter rules" oninput="renderRuleRows()">
+    <table id="rule-table" style="border-collapse: collapse; width: 100%; margin-top: 5px;">
+        <thead><tr>
+            <th onclick="sortRuleRows('type')">Type</th>
+            <th onclick="sortRuleRows('index')">#</th>
+            <th onclick="sortRuleRows('src')">Source</th>
+            <th onclick="sortRuleRows('dst')">Destination</th>
+            <th onclick="sortRuleRows('ports')">Ports</th>
+            <th onclick="sortRuleRows('summary')">Summary</th>
+            <th onclick="sortRuleRows('location')">Line</th>
+        </tr></thead>
+        <tbody></tbody>
+    </table>
+</div>
+<style>
+#rule-table th { cursor: pointer; text-align: left; border-bottom: 2px solid #ccc; }
+#rule-table td { border-bottom: 1px solid #eee; padding: 2px 6px; }
+#rule-table tr.selected-rule td { background-color: #fff3b0; }
+</style>
+<script>
+var ruleRows = """ + rows_json + """;
+var ruleSort = {key: null, descending: false};
+var selectedRuleRows = {};
+function renderRuleRows() {
+    var filter = document.getElementById("rule-filter").value.toLowerCase();
+    var tbody = document.querySelector("#rule-table tbody");
+    tbody.innerHTML = "";
+    ruleRows.forEach(function (row, i) {
+        var cells = [row.type, row.index, row.src, row.dst, row.ports, row.summary, row.location];
+        if (filter && cells.join(" ").toLowerCase().indexOf(filter) === -1) {
+            return;
+        }
+        var tr = document.createElement("tr");
+        tr.id = "rule-row-" + i;
+        if (selectedRuleRows[i]) {
+            tr.className = "selected-rule";
+        }
+        cells.forEach(function (value) {
+            var td = document.createElement("td");
+            td.textContent = value;
+            tr.appendChild(td);
+        });
+        tr.onmouseenter = function () { highlightRuleEdges(row); };
+        tr.onmouseleave = function () { network.unselectAll(); };
+        tbody.appendChild(tr);
+    });
+}
+function sortRuleRows(key) {
+    ruleSort.descending = ruleSort.key === key ? !ruleSort.descending : false;
+    ruleSort.key = key;
+    ruleRows.sort(function (a, b) {
+        var order = a[key] < b[key] ? -1 : a[key] > b[key] ? 1 : 0;
+        return ruleSort.descending ? -order : order;
+    });
+    selectedRuleRows = {};
+    renderRuleRows();
+}
+function highlightRuleEdges(row) {
+    var ids = edges.get({filter: function (edge) {
+        return row.edges.some(function (pair) { return pair[0] === edge.from && pair[1] === edge.to; });
+    }}).map(function (edge) { return edge.id; });
+    network.setSelection({nodes: [], edges: ids}, {unselectAll: true, highlightEdges: false});
+}
+network.on("selectEdge", function (params) {
+    if (params.nodes.length) {
+        return;
+    }
+    var edge = edges.get(params.edges[0]);
+    selectedRuleRows = {};
+    ruleRows.forEach(function (row, i) {
+        if (row.edges.some(function (pair) { return pair[0] === edge.from && pair[1] === edge.to; })) {
+            selectedRuleRows[i] = true;
+        }
+    });
+    renderRuleRows();
+    var first = document.querySelector("#rule-table tr.selected-rule");
+    if (first) {
+        first.scrollIntoView({behavior: "smooth", block: "center"});
+    }
+});
+network.on("deselectEdge", function () {
+    selectedRuleRows = {};
+    renderRuleRows();
+});
+renderRuleRows();
+</script>
+"""
+
+
+def compute_policy_stats(acls, grants, ssh_rules, hosts, groups, tag_owners, stats_config):
+    # Coverage numbers for the CLI summary and the stats panel. Sources
+    # matching admin_groups don't count towards host reachability since they
+    # are expected to reach everything.
+    admin_patterns = stats_config.get('admin_groups', ['*admin*', 'autogroup:owner'])
+
+    def is_admin(src):
+        return any(fnmatch.fnmatch(src, pattern) for pattern in admin_patterns)
+
+    # ACL rules, grants and SSH rules as (sources, {destination: ports});
+    # SSH rules reach port 22 and app-only grants no port at all
+    rules = []
+    for rule in acls:
+        targets = {}
+        for dst in rule.get('dst', []):
+            base, ports = split_target(dst)
+            targets.setdefault(base, []).extend(ports.split(','))
+        rules.append((rule.get('src', []), targets))
+    for grant in grants:
+        ports = [entry.rpartition(':')[2] for entry in grant.get('ip', [])]
+        rules.append((grant['src'], {dst: ports for dst in grant['dst']}))
+    for rule in ssh_rules:
+        rules.append((rule['src'], {dst: ['22'] for dst in rule['dst']}))
+
+    rules_per_tag = {tag: 0 for tag in tag_owners}
+    wildcard_rules = 0
+    reachable_hosts = set()
+    host_names = set(hosts)
+    inbound_rules = {}
+    group_reach = {}
+    port_usage = {}
+    for srcs, targets in rules:
+        bases = set(targets)
+        for base in bases:
+            inbound_rules[base] = inbound_rules.get(base, 0) + 1
+        for src in srcs:
+            if src.startswith(('group:', 'autogroup:')):
+                group_reach.setdefault(src, set()).update(bases)
+        for ports in targets.values():
+            for port in ports:
+                port_usage[port] = port_usage.get(port, 0) + 1
+        if '*' in srcs or '*' in bases:
+            wildcard_rules += 1
+        for base in bases:
+            if base.startswith('tag:'):
+                rules_per_tag[base] = rules_per_tag.get(base, 0) + 1
+        non_admin_group_src = any(
+            src.startswith(('group:', 'autogroup:')) and not is_admin(src) for src in srcs)
+        if non_admin_group_src:
+            if '*' in bases:
+                reachable_hosts |= host_names
+            else:
+                reachable_hosts |= bases & host_names
+
+    ssh_users = {}
+    for rule in ssh_rules:
+        for user in rule['users']:
+            ssh_users[user] = ssh_users.get(user, 0) + 1
+
+    return {
+        'rules': len(acls),
+        'grants': len(grants),
+        'ssh_rules': len(ssh_rules),
+        'ssh_check_rules': sum(1 for rule in ssh_rules if rule['action'] == 'check'),
+        'top_ssh_users': top_n(ssh_users, stats_config),
+        'groups': len(groups),
+        'tags': len(tag_owners),
+        'hosts': len(hosts),
+        'hosts_reachable_by_non_admin_groups': len(reachable_hosts),
+        'hosts_reachable_percent': round(100 * len(reachable_hosts) / len(hosts)) if hosts else 0,
+        'wildcard_rules': wildcard_rules,
+        'rules_per_tag': dict(sorted(rules_per_tag.items(), key=lambda item: (-item[1], item[0]))),
+        'top_destinations': top_n(inbound_rules, stats_config),
+        'top_groups_by_reach': top_n({group: len(reach) for group, reach in group_reach.items()}, stats_config),
+        'largest_groups': top_n({group: len(expand_group(group, groups)) for group in groups}, stats_config),
+        'top_ports': top_n(port_usage, stats_config),
+    }
+
+
+def top_n(counts, stats_config):
+    ranked = sorted(counts.items(), key=lambda item: (-item[1], item[0]))
+    return dict(ranked[:stats_config.get('top_n', 5)])
+
+
+def print_policy_stats(stats):
+    print(f"{stats['rules']} ACL rules, {stats['grants']} grants, {stats['ssh_rules']} SSH rules "
+          f"({stats['ssh_check_rules']} in check mode), {stats['groups']} groups, {stats['tags']} tags, {stats['hosts']} hosts")
+    print(f"{stats['hosts_reachable_by_non_admin_groups']}/{stats['hosts']} hosts "
+          f"({stats['hosts_reachable_percent']}%) reachable by non-admin groups")
+    print(f"{stats['wildcard_rules']} rule(s) with a '*' source or destination")
+    print(f"Policy hash {stats['policy_hash'][:12]}, graph hash {stats['graph_hash'][:12]}")
+    unused = [tag for tag, count in stats['rules_per_tag'].items() if count == 0]
+    if unused:
+        print(f"Tags with no rules targeting them: {', '.join(unused)}")
+
+
+def hash_policy_sources(policy_sources):
+    digest = hashlib.sha256()
+    for source in sorted(policy_sources):
+        digest.update(source.encode('utf-8') + b'\0' + policy_sources[source].encode('utf-8') + b'\0')
+    return digest.hexdigest()
+
+
+def canonical_json(value):
+    # JSON that doesn't depend on key or list order, since neither rule order
+    # nor the order of src/dst entries changes what a policy allows
+    def normalize(item):
+        if isinstance(item, dict):
+            return {str(key): normalize(val) for key, val in item.items()}
+        if isinstance(item, (list, tuple, set)):
+            return sorted((normalize(val) for val in item), key=lambda val: json.dumps(val, sort_keys=True))
+        if isinstance(item, (str, int, float, bool)) or item is None:
+            return item
+        return str(item)
+    return json.dumps(normalize(value), sort_keys=True, separators=(',', ':'))
+
+
+def hash_policy(policy):
+    # Unlike hash_policy_sources this ignores comments, formatting and order,
+    # so it only changes when the policy's meaning might have
+    return hashlib.sha256(canonical_json(policy).encode('utf-8')).hexdigest()
+
+
+def hash_graph(graph):
+    return hashlib.sha256(canonical_json(graph).encode('utf-8')).hexdigest()
+
+
+def append_audit_log(filename, record):
+    log_dir = os.path.dirname(filename)
+    if log_dir:
+        os.makedirs(log_dir, exist_ok=True)
+    with open(filename, 'a') as f:
+        f.write(json.dumps(record, sort_keys=True) + "\n")
+
+
+def read_last_audit_record(filename):
+    # The newest record in an audit log, or None if there is no log or no
+    # complete record in it (blank lines and a half-written last line, say
+    # from a run that was killed, are skipped)
+    try:
+        with open(filename, 'r') as f:
+            lines = f.read().splitlines()
+    except OSError:
+        return None
+    for line in reversed(lines):
+        if not line.strip():
+            continue
+        try:
+            record = json.loads(line)
         except ValueError:
-            # If loading as JSON fails, try loading as HuJSON
-            f.seek(0)
+            continue
+        if isinstance(record, dict):
+            return record
+    return None
+
+
+def build_stats_table_html(heading, unit, counts):
+    rows = "".join(f"<tr><td>{html.escape(name)}</td><td>{count}</td></tr>" for name, count in counts.items())
+    return f'<table style="font-size: 12px;"><tr><th>{heading}</th><th>{unit}</th></tr>{rows}</table>'
+
+
+def build_stats_html(stats):
+    return f"""    <details>
+        <summary>Policy stats</summary>
+        <div>{stats['rules']} ACL rules, {stats['grants']} grants, {stats['ssh_rules']} SSH rules ({stats['ssh_check_rules']} in check mode), {stats['groups']} groups, {stats['tags']} tags, {stats['hosts']} hosts</div>
+        <div>{stats['hosts_reachable_percent']}% of hosts reachable by non-admin groups</div>
+        <div>{stats['wildcard_rules']} wildcard rule(s)</div>
+        <div title="{stats['policy_hash']} / {stats['graph_hash']}">Policy hash {stats['policy_hash'][:12]}, graph hash {stats['graph_hash'][:12]}</div>
+        {build_stats_table_html("Destination tag", "Rules", stats['rules_per_tag'])}
+        {build_stats_table_html("Top destination", "Inbound rules", stats['top_destinations'])}
+        {build_stats_table_html("Group", "Destinations reached", stats['top_groups_by_reach'])}
+        {build_stats_table_html("Largest group", "Members", stats['largest_groups'])}
+        {build_stats_table_html("Port", "Uses", stats['top_ports'])}
+        {build_stats_table_html("SSH user", "Rules", stats['top_ssh_users'])}
+    </details>
+"""
+
+
+def new_anonymizer():
+    # Pseudonyms come from a random salt: the same name gets the same
+    # pseudonym everywhere in one run, but runs can't be correlated
+    anonymizer = {'salt': secrets.token_bytes(16), 'hosts': set(), 'addresses': {}}
+    add_anonymized_hosts(anonymizer, [])
+    return anonymizer
+
+
+def add_anonymized_hosts(anonymizer, host_names):
+    # Host names are replaced wherever they appear as a whole word, including
+    # in comments and remarks
+    anonymizer['hosts'].update(name for name in host_names if isinstance(name, str) and name)
+    alternatives = [USER_LOGIN_PATTERN.pattern, IPV4_PATTERN.pattern, IPV6_PATTERN.pattern]
+    alternatives += [rf"(?<![\w.@-]){re.escape(name)}(?![\w.@-])"
+                     for name in sorted(anonymizer['hosts'], key=len, reverse=True)]
+    anonymizer['text_pattern'] = re.compile('|'.join(alternatives))
+    anonymizer['file_pattern'] = re.compile(r'"(?:[^"\\\n]|\\.)*"|' + '|'.join(alternatives))
+
+
+def pseudonym(anonymizer, kind, value):
+    digest = hmac.new(anonymizer['salt'], f"{kind}\0{value}".encode('utf-8'), hashlib.sha256).hexdigest()
+    return f"{kind}-{digest[:8]}"
+
+
+def anonymize_domain(anonymizer, domain):
+    return f"{pseudonym(anonymizer, 'domain', domain.lower())}.example"
+
+
+def anonymize_address(anonymizer, address):
+    # Prefix-preserving: each bit is flipped or not depending on the bits
+    # before it, so addresses in one network still share a prefix and
+    # networks still contain their hosts
+    if address not in anonymizer['addresses']:
+        width = address.max_prefixlen
+        bits = int(address)
+        result = 0
+        for i in range(width):
+            prefix = f"{address.version}/{i}/{bits >> (width - i)}".encode('utf-8')
+            flip = hmac.new(anonymizer['salt'], prefix, hashlib.sha256).digest()[0] & 1
+            result = (result << 1) | (((bits >> (width - 1 - i)) & 1) ^ flip)
+        anonymizer['addresses'][address] = type(address)(result)
+    return anonymizer['addresses'][address]
+
+
+def anonymize_name(anonymizer, value):
+    # The pseudonym for an email, host name, FQDN, address, network, range or
+    # target with ports, or None if value is none of these
+    for prefix in ('host:', 'add ', 'remove '):
+        if value.startswith(prefix):
+            rest = anonymize_name(anonymizer, value[len(prefix):])
+            return prefix + rest if rest else None
+    if USER_LOGIN_PATTERN.fullmatch(value):
+        return f"{pseudonym(anonymizer, 'user', value)}@{anonymize_domain(anonymizer, value.rpartition('@')[2])}"
+    if value in anonymizer['hosts']:
+        return pseudonym(anonymizer, 'host', value)
+    if FQDN_PATTERN.fullmatch(value):
+        return f"{pseudonym(anonymizer, 'host', value.lower())}.example"
+    if '-' in value and not value.startswith('-'):
+        first, _, last = value.partition('-')
+        if is_ip_address(first) and is_ip_address(last) and '/' not in value:
+            # Prefix-preserving doesn't preserve order, so the ends may swap
+            ends = sorted(anonymize_address(anonymizer, ipaddress.ip_address(end)) for end in (first, last))
+            return f"{ends[0]}-{ends[1]}"
+    if is_ip_address(value):
+        network = ipaddress.ip_network(value, strict=False)
+        address = anonymize_address(anonymizer, ipaddress.ip_address(value.partition('/')[0]))
+        if '/' not in value:
+            return str(address)
+        return str(ipaddress.ip_network((address, network.prefixlen), strict=False))
+    base, ports = split_target(value)
+    if base != value:
+        name = anonymize_name(anonymizer, base)
+        if name:
+            return f"[{name}]:{ports}" if value.startswith('[') else f"{name}:{ports}"
+    return None
+
+
+def anonymize_string(anonymizer, value):
+    # Free text such as comments and remarks keeps its wording; only the
+    # emails and addresses in it are replaced
+    name = anonymize_name(anonymizer, value)
+    if name is not None:
+        return name
+    return anonymizer['text_pattern'].sub(lambda m: anonymize_name(anonymizer, m.group(0)) or m.group(0), value)
+
+
+def anonymize_value(anonymizer, value):
+    if isinstance(value, dict):
+        return {anonymize_value(anonymizer, k): anonymize_value(anonymizer, v) for k, v in value.items()}
+    if isinstance(value, list):
+        return [anonymize_value(anonymizer, entry) for entry in value]
+    if isinstance(value, str):
+        return anonymize_string(anonymizer, value)
+    return value
+
+
+def anonymize_text(anonymizer, text):
+    # Rewrites the strings, comments and bare values of a policy file in
+    # place, so line numbers still point at the same rules
+    def replace(match):
+        token = match.group(0)
+        if token.startswith('"'):
+            return f'"{anonymize_string(anonymizer, token[1:-1])}"'
+        return anonymize_name(anonymizer, token) or token
+
+    return anonymizer['file_pattern'].sub(replace, text)
+
+
+def anonymize_policy(anonymizer, acl_data, sources, provenance):
+    # File paths and API URLs name the organization as well, so sources become
+    # source-1, source-2, ... in load order; the labels are returned so the
+    # caller can rename the paths it kept
+    labels = {source: f"source-{number}" for number, source in enumerate(sources, 1)}
+    acl_data = anonymize_value(anonymizer, acl_data)
+    sources = {labels[source]: anonymize_text(anonymizer, text) for source, text in sources.items()}
+    provenance = {section: {anonymize_string(anonymizer, key): labels[origin] for key, origin in origins.items()}
+                  if isinstance(origins, dict) else
+                  [(labels[origin], position) for origin, position in origins]
+                  if isinstance(origins, list) else origins
+                  for section, origins in provenance.items()}
+    return acl_data, sources, provenance, labels
+
+
+def load_devices(source, tailnet, config):
+    # The device list from the Tailscale API, or a saved copy of it
+    if source == 'api':
+        source = get_tailnet_api_url(tailnet or '-', 'devices?fields=all')
+    text = read_policy_text(source, config)
+    if text is None:
+        return None
+    data = load_json_or_hujson_text(text, source)
+    if isinstance(data, dict):
+        data = data.get('devices')
+    if not isinstance(data, list) or not all(isinstance(device, dict) for device in data):
+        print(f"Error: '{source}' is not a Tailscale device list")
+        return None
+    return data
+
+
+def find_policy_drift(tag_owners, auto_approvers, devices):
+    # Where the policy and the devices actually in the tailnet disagree: tags
+    # nobody uses, tags nobody may own, and auto-approved routes nobody
+    # advertises
+    drift = []
+    devices_by_tag = {}
+    advertised = []
+    for device in devices:
+        name = device.get('name') or device.get('hostname') or device.get('id', "?")
+        for tag in device.get('tags') or []:
+            devices_by_tag.setdefault(tag, []).append(name)
+        for route in device.get('advertisedRoutes') or []:
             try:
-                data = hjson.load(f)
-                return data
-            except Exception as e:
-                print(f"Error decoding '{filename}' as HuJSON: {e}")
-                return None
-
-
-# Step 1: Parse the ACL File using json
-acl_file_path = 'policy.hujson'
-acl_data = load_json_or_hujson_file(acl_file_path)
-if acl_data is None:
-    print("Error: Could not parse ACL policy file")
-    exit(1)
-
-# Step 2: Extract Hosts, Groups, and Tag Owners
-hosts = acl_data.get('hosts', {})
-groups = acl_data.get('groups', {})
-tag_owners = acl_data.get('tagOwners', {})
-
-# Step 3: Extract ACL Rules
-acls = acl_data.get('acls', [])
-
-# Preprocess ACL rules to merge nodes with similar hostnames
-merged_acls = []
-for rule in acls:
-    src = set()
-    dst = set()
-    for node in rule['src']:
-        if node.startswith('tag:'):
-            src.add(node)  # Preserve the entire tag format
-            #src.add(node.split(':')[1])  # Extract tag name
-        elif node.startswith('autogroup:'):
-            src.add(node)  # Preserve the entire autogroup format
-        elif node.startswith('group:'):
-            src.add(node)  # Preserve the entire group format
-            #src.add(node.split(':')[1])  # Extract group name
-        else:
-            hostname = node.split(':')[0]  # Extract hostname
-            src.add(hostname)
-    for node in rule['dst']:
-        if node.startswith('tag:'):
-            dst.add(node)  # Preserve the entire tag format
-            #dst.add(node.split(':')[1])  # Extract tag name
-        elif node.startswith('autogroup:'):
-            dst.add(node)  # Preserve the entire autogroup format
-            #dst.add(node.split(':')[1])  # Extract group name
-        elif node.startswith('group:'):
-            dst.add(node)  # Preserve the entire group format
-            #dst.add(node.split(':')[1])  # Extract group name
-        else:
-            hostname = node.split(':')[0]  # Extract hostname
-            dst.add(hostname)
-    merged_acls.append({'action': rule['action'], 'src': src, 'dst': dst})
-
-# Step 4: Construct Network Topology Graph
-net = Network(height="800px", width="100%", notebook=True, directed=True, filter_menu=True,select_menu=True,neighborhood_highlight=True, cdn_resources='remote')
-
-# Define colors for different node types
-group_color = "#FFFF00"  # Group color (Yellow)
-tag_color = "#00cc66"    # Tag color (Green)
-host_color = "#ff6666"   # Host color (Red)
-
-# TODO: Coalesce this into a smaller function
-# Add nodes and edges based on preprocessed ACL rules
-for rule in merged_acls:
-    for src in rule['src']:
-        if src.startswith('tag:'):
-            net.add_node(src, color=tag_color)
-        elif COMPANY_DOMAIN in src:
-            net.add_node(src, color=group_color)
-        elif src.startswith('autogroup:'):
-            net.add_node(src, color=group_color)
-        elif 'group:' in groups:
-            net.add_node(src, color=group_color)
-        else:
-            net.add_node(src, color=host_color)
-            
-        for dst in rule['dst']:
-            if dst.startswith('tag:'):
-                net.add_node(dst, color=tag_color)
-            elif COMPANY_DOMAIN in dst:
-                net.add_node(dst, color=group_color)
-            elif dst.startswith('autogroup:'):
-                net.add_node(dst, color=group_color)                
-            elif 'group:' in groups:
-                net.add_node(dst, color=group_color)
-            else:
-                net.add_node(dst, color=host_color)
-            net.add_edge(src, dst, arrows={'to': {'enabled': True}})  # Specify arrow options as a dictionary
+                advertised.append(ipaddress.ip_network(route, strict=False))
+            except ValueError:
+                continue
+    for tag in sorted(tag_owners):
+        if tag not in devices_by_tag:
+            drift.append(f"{tag} is in tagOwners but no device has it")
+    for tag, names in sorted(devices_by_tag.items()):
+        if tag not in tag_owners:
+            drift.append(f"{', '.join(sorted(names))} tagged {tag}, which is not in tagOwners")
+    for route in sorted(auto_approvers.get('routes', {})):
+        try:
+            network = ipaddress.ip_network(route, strict=False)
+        except ValueError:
+            continue
+        if not any(a.version == network.version and a.subnet_of(network) for a in advertised):
+            drift.append(f"Route {route} is auto-approved but no device advertises it")
+    if auto_approvers.get('exitNode') and not any(a.prefixlen == 0 for a in advertised):
+        drift.append("Exit nodes are auto-approved but no device advertises itself as one")
+    return drift
 
 
-# Step 5: Add a legend for the colors
-legend_html = """
+def build_legend_html(settings, stats):
+    legend_html = """
 <div style="position: absolute; top: 10px; right: 10px; background-color: #f5f5f5; padding: 10px; border: 1px solid #ccc;">
     <h3>Legend</h3>
-    <div style="background-color: """ + group_color + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <div style="background-color: """ + node_colors['group'] + """; width: 20px; height: 20px; display: inline-block;"></div>
     <span>Group</span><br>
-    <div style="background-color: """ + tag_color + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <div style="background-color: """ + node_colors['tag'] + """; width: 20px; height: 20px; display: inline-block;"></div>
     <span>Tag</span><br>
-    <div style="background-color: """ + host_color + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <div style="background-color: """ + node_colors['host'] + """; width: 20px; height: 20px; display: inline-block;"></div>
     <span>Host</span>
+"""
+    if network_hosts:
+        legend_html += """    <br>
+    <div style="background-color: """ + node_colors['network'] + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <span>Network (CIDR host)</span>
+"""
+    if stats['ipsets']:
+        legend_html += """    <br>
+    <div style="background-color: """ + node_colors['ipset'] + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <span>IP set</span>
+"""
+    if settings['wildcard_nodes']:
+        legend_html += """    <br>
+    <div style="background-color: """ + node_colors['wildcard'] + """; width: 14px; height: 14px; display: inline-block; transform: rotate(45deg); margin: 3px;"></div>
+    <span>Wildcard / internet</span>
+"""
+    legend_html += """    <br>
+    <div style="border-top: 2px dotted """ + node_colors['ssh'] + """; width: 20px; display: inline-block; vertical-align: middle;"></div>
+    <span>Tailscale SSH</span>
+"""
+    if settings['show_auto_approvers']:
+        legend_html += """    <br>
+    <div style="border-top: 2px dashed """ + node_colors['approval'] + """; width: 20px; display: inline-block; vertical-align: middle;"></div>
+    <span>Route / exit node auto-approval</span>
+"""
+    if settings['show_derp']:
+        legend_html += """    <br>
+    <div style="background-color: """ + node_colors['derp'] + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <span>DERP region / server</span>
+"""
+    if settings['show_orphans']:
+        legend_html += """    <br>
+    <div style="background-color: """ + node_colors['orphan'] + """; width: 20px; height: 20px; display: inline-block;"></div>
+    <span>Not used by any rule</span>
+"""
+    if settings['show_tag_owners']:
+        legend_html += """    <br>
+    <div style="border-top: 2px dashed """ + node_colors['ownership'] + """; width: 20px; display: inline-block; vertical-align: middle;"></div>
+    <span>Tag ownership</span>
+"""
+    legend_html += build_stats_html(stats)
+    legend_html += "</div>\n"
+    return legend_html
+
+
+def build_skipped_rules_html(skipped):
+    if not skipped:
+        return ""
+    items = "".join(f"<li>{html.escape(description)}: {html.escape('; '.join(problems))}</li>"
+                    for description, problems in skipped)
+    return f"""
+<div style="position: absolute; top: 10px; left: 50%; transform: translateX(-50%); background-color: #ffe0e0; padding: 10px; border: 1px solid #cc0000; max-width: 50%;">
+    <strong>{len(skipped)} invalid rule(s) were skipped and are not shown:</strong>
+    <ul style="margin: 5px 0 0 0;">{items}</ul>
+</div>
+"""
+
+
+def build_drift_html(drift):
+    if not drift:
+        return ""
+    items = "".join(f"<li>{html.escape(message)}</li>" for message in drift)
+    return f"""
+<div style="position: absolute; top: 10px; left: 10px; background-color: #fff4e0; padding: 10px; border: 1px solid #e69500; max-width: 30%;">
+    <details open>
+        <summary><strong>Drift: {len(drift)} difference(s) between the policy and the tailnet</strong></summary>
+        <ul style="margin: 5px 0 0 0;">{items}</ul>
+    </details>
+</div>
+"""
+
+
+def build_badge_svg(label, message, color):
+    # Flat shields.io-style badge. Text isn't measured; Verdana at 11px
+    # averages about 7px a character, which is close enough for short text.
+    label_width = 10 + 7 * len(label)
+    message_width = 10 + 7 * len(message)
+    width = label_width + message_width
+    label, message = html.escape(label), html.escape(message)
+    return f"""<svg xmlns="http://www.w3.org/2000/svg" width="{width}" height="20" role="img" aria-label="{label}: {message}">
+  <title>{label}: {message}</title>
+  <linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+  <clipPath id="r"><rect width="{width}" height="20" rx="3" fill="#fff"/></clipPath>
+  <g clip-path="url(#r)">
+    <rect width="{label_width}" height="20" fill="#555"/>
+    <rect x="{label_width}" width="{message_width}" height="20" fill="{color}"/>
+    <rect width="{width}" height="20" fill="url(#s)"/>
+  </g>
+  <g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+    <text x="{label_width / 2}" y="14">{label}</text>
+    <text x="{label_width + message_width / 2}" y="14">{message}</text>
+  </g>
+</svg>
+"""
+
+
+def write_badges(directory, stats, lint_counts):
+    # rules.svg, warnings.svg and updated.svg for the policy repo's README;
+    # returns the paths written
+    rules = stats['rules'] + stats['grants'] + stats['ssh_rules']
+    errors, warnings = lint_counts.get('error', 0), lint_counts.get('warning', 0)
+    if errors:
+        lint = (f"{errors} error(s), {warnings} warning(s)", "#e05d44")
+    elif warnings:
+        lint = (f"{warnings} warning(s)", "#dfb317")
+    else:
+        lint = ("passing", "#4c1")
+    badges = {
+        'rules.svg': build_badge_svg("policy rules", str(rules), "#007ec6"),
+        'warnings.svg': build_badge_svg("policy lint", *lint),
+        'updated.svg': build_badge_svg("map updated", datetime.now(timezone.utc).strftime('%Y-%m-%d'), "#007ec6"),
+    }
+    os.makedirs(directory, exist_ok=True)
+    paths = []
+    for name, svg in badges.items():
+        path = os.path.join(directory, name)
+        with open(path, 'w') as f:
+            f.write(svg)
+        paths.append(path)
+    return paths
+
+
+def build_footer_html():
+    generated_at = datetime.now(timezone.utc).strftime('%Y-%m-%d %H:%M UTC')
+    commit, built = get_build_info()
+    return f"""
+<div style="position: absolute; bottom: 10px; right: 10px; color: #888; font-size: 11px;">
+    Generated {generated_at} by tailscale-network-topology-mapper {__version__} (commit {commit}, built {built})
 </div>
 """
 
-# Inject the legend HTML into the network visualization
-net.show_buttons()
-net.write_html("network_topology.html")
-with open("network_topology.html", "a") as f:
-    f.write(legend_html)
+
+def run_lint_checks(acl_data, acls, grants, groups, hosts, tag_owners, redundant_acls, sources, provenance):
+    # Returns (check, message) for everything worth a second look that
+    # doesn't stop the policy from being mapped
+    findings = []
+    for where, reference in find_undefined_references(acl_data):
+        check = 'missing-tag-owner' if reference.startswith('tag:') else 'undefined-reference'
+        findings.append((check, f"{where} references '{reference}', which is not defined"))
+    findings += [('host-conflict', message) for message in find_host_conflicts(hosts, groups, tag_owners)]
+    for section, rules in (('acls', acls), ('grants', grants)):
+        label = {'acls': "ACL rule", 'grants': "Grant"}[section]
+        for index, rule in enumerate(rules):
+            broad = [dst for dst in rule['dst'] if split_target(dst)[0] == '*']
+            if broad:
+                location = get_rule_location(section, index, sources, provenance)
+                where = f" ({location[0]}, line {location[1]})" if location else ""
+                findings.append(('broad-destination', f"{label} #{index}{where} lets {', '.join(rule['src'])} "
+                                                      f"reach every destination ({', '.join(broad)})"))
+    for index, covered_by in redundant_acls:
+        location = get_rule_location('acls', index, sources, provenance)
+        where = f" ({location[0]}, line {location[1]})" if location else ""
+        findings.append(('redundant-acl', f"ACL rule #{index}{where} only grants access that grant(s) "
+                                          f"{', '.join(f'#{i}' for i in covered_by)} already give"))
+    for section, index, earlier, duplicate in find_shadowed_rules(acls, grants, groups, hosts):
+        label = {'acls': "ACL rule", 'grants': "Grant"}[section]
+        location = get_rule_location(section, index, sources, provenance)
+        earlier_location = get_rule_location(section, earlier, sources, provenance)
+        where = f" ({location[0]}, line {location[1]})" if location else ""
+        earlier_where = f" (line {earlier_location[1]})" if earlier_location else ""
+        relation = "is a duplicate of" if duplicate else "is fully covered by"
+        findings.append(('shadowed-rule', f"{label} #{index}{where} {relation} {label} "
+                                          f"#{earlier}{earlier_where} and can be removed"))
+    for section, name in find_unreferenced_definitions(acl_data):
+        location = get_definition_location(section, name, sources, provenance)
+        where = f" ({location[0]}, line {location[1]})" if location else ""
+        findings.append(('unreferenced-definition', f"'{name}'{where} is defined in {section} but no rule uses it"))
+    return findings
+
+
+def report_lint_findings(findings, lint_config):
+    # Prints each finding with its severity and returns how many there were
+    # of each severity
+    severities = dict(LINT_CHECKS)
+    for check, severity in lint_config.get('severities', {}).items():
+        if check not in LINT_CHECKS or severity not in LINT_SEVERITIES:
+            warn(f"Ignoring lint severity '{severity}' for '{check}': checks are {', '.join(LINT_CHECKS)} "
+                 f"and severities {', '.join(LINT_SEVERITIES)}")
+            continue
+        severities[check] = severity
+    counts = {}
+    for check, message in findings:
+        severity = severities[check]
+        if severity == 'off':
+            continue
+        counts[severity] = counts.get(severity, 0) + 1
+        if severity == 'warning':
+            warn(f"[{check}] {message}")
+        else:
+            print(f"Error: [{check}] {message}")
+            run_warnings.append(f"[{check}] {message}")
+    return counts
+
+
+def load_inventory(filename):
+    # A list of tailnets, each {"name": ..., "tailnet": ...} to read the policy
+    # from the API (optionally with "api_key_env", the variable holding that
+    # tailnet's key) or {"name": ..., "policy": ...} for a file or URL. YAML
+    # (.yaml/.yml) works too when PyYAML is installed.
+    if filename.endswith(('.yaml', '.yml')):
+        try:
+            import yaml
+        except ImportError:
+            print(f"Error: Reading '{filename}' needs PyYAML (pip install pyyaml); or write it as JSON/HuJSON")
+            return None
+        if not os.path.isfile(filename):
+            print(f"Error: File '{filename}' not found.")
+            return None
+        try:
+            with open(filename, 'r') as f:
+                inventory = yaml.safe_load(f)
+        except yaml.YAMLError as e:
+            print(f"Error: Could not parse '{filename}': {e}")
+            return None
+    else:
+        inventory = load_json_or_hujson_file(filename)
+    entries = inventory.get('tailnets') if isinstance(inventory, dict) else inventory
+    if not isinstance(entries, list):
+        print(f"Error: '{filename}' must be a list of tailnets (or have a \"tailnets\" list)")
+        return None
+    names = set()
+    for index, entry in enumerate(entries):
+        if not isinstance(entry, dict) or not isinstance(entry.get('name'), str) or \
+                ('tailnet' in entry) == ('policy' in entry):
+            print(f"Error: Inventory entry #{index} needs a \"name\" and either \"tailnet\" or \"policy\"")
+            return None
+        if entry['name'] in names:
+            print(f"Error: Inventory entry #{index}: '{entry['name']}' is listed twice")
+            return None
+        names.add(entry['name'])
+    return entries
+
+
+def run_inventory(filename, output_dir, config_file):
+    # Maps every tailnet in its own subdirectory by running the mapper on it,
+    # then rolls the audit records up into a scorecard
+    entries = load_inventory(filename)
+    if entries is None:
+        exit(1)
+    os.makedirs(output_dir, exist_ok=True)
+    rows = []
+    for entry in entries:
+        directory = re.sub(r"[^A-Za-z0-9._-]", "_", entry['name'])
+        log_path = os.path.join(output_dir, directory, "audit.jsonl")
+        if os.path.exists(log_path):
+            os.remove(log_path)
+        command = [sys.executable, os.path.abspath(__file__), '--output-dir', os.path.join(output_dir, directory),
+                   '--audit-log', log_path]
+        if 'tailnet' in entry:
+            command += ['--tailnet', entry['tailnet']]
+        else:
+            command += ['--policy', resolve_import_path(filename, entry['policy'])]
+        config_path = resolve_import_path(filename, entry['config']) if 'config' in entry else config_file
+        if config_path:
+            command += ['--config', config_path]
+        # The child only gets the options above: TSMAP_ flags or config keys
+        # meant for this run (say TSMAP_POLICY or TSMAP_TAILNET) would clash
+        # with the tailnet's own
+        env = {name: value for name, value in os.environ.items() if not name.startswith(ENV_PREFIX)}
+        if entry.get('api_key_env'):
+            env['TAILSCALE_API_KEY'] = os.environ.get(entry['api_key_env'], "")
+        print(f"Mapping {entry['name']}...")
+        result = subprocess.run(command, env=env, capture_output=True, text=True)
+        record = read_last_audit_record(log_path)
+        if record is None:
+            errors = [line for line in result.stdout.splitlines() if line.startswith("Error")]
+            warn(f"Could not map {entry['name']}: {errors[0] if errors else 'exit code ' + str(result.returncode)}")
+        rows.append(get_inventory_row(entry['name'], directory, record))
+    with open(os.path.join(output_dir, "inventory.csv"), 'w', newline='') as f:
+        writer = csv.DictWriter(f, fieldnames=list(INVENTORY_COLUMNS))
+        writer.writeheader()
+        writer.writerows({key: row[key] for key in INVENTORY_COLUMNS} for row in rows)
+    with open(os.path.join(output_dir, "inventory.html"), 'w') as f:
+        f.write(build_inventory_html(rows))
+    failed = sum(1 for row in rows if row['status'] == "failed")
+    print(f"Mapped {len(rows) - failed} of {len(rows)} tailnets; scorecard written to "
+          f"{os.path.join(output_dir, 'inventory.html')} and inventory.csv")
+    exit(1 if failed else 0)
+
+
+# Scorecard columns: CSV header -> heading in inventory.html
+INVENTORY_COLUMNS = {
+    'tailnet': "Tailnet",
+    'status': "Status",
+    'acl_rules': "ACL rules",
+    'grants': "Grants",
+    'wildcard_rules': "Wildcard rules",
+    'hosts_reachable_percent': "Hosts reachable by non-admins (%)",
+    'lint_errors': "Lint errors",
+    'lint_warnings': "Lint warnings",
+    'skipped_rules': "Invalid rules",
+    'policy_hash': "Policy hash",
+}
+
+
+def get_inventory_row(name, directory, record):
+    if record is None:
+        return dict({key: "" for key in INVENTORY_COLUMNS}, tailnet=name, status="failed", link=None)
+    stats = record['stats']
+    lint = record.get('lint_findings', {})
+    return {
+        'tailnet': name,
+        'status': "lint errors" if lint.get('error') else "ok",
+        'acl_rules': stats['rules'],
+        'grants': stats['grants'],
+        'wildcard_rules': stats['wildcard_rules'],
+        'hosts_reachable_percent': stats['hosts_reachable_percent'],
+        'lint_errors': lint.get('error', 0),
+        'lint_warnings': lint.get('warning', 0),
+        'skipped_rules': record['skipped_rules'],
+        'policy_hash': stats['policy_hash'][:12],
+        'link': f"{directory}/network_topology.html",
+    }
+
+
+def build_inventory_html(rows):
+    colors = {"ok": "#e0ffe0", "lint errors": "#fff4e0", "failed": "#ffe0e0"}
+    header = "".join(f"<th>{html.escape(heading)}</th>" for heading in INVENTORY_COLUMNS.values())
+    body = ""
+    for row in rows:
+        cells = []
+        for key in INVENTORY_COLUMNS:
+            value = html.escape(str(row[key]))
+            if key == 'tailnet' and row['link']:
+                value = f'<a href="{html.escape(row["link"])}">{value}</a>'
+            cells.append(f"<td>{value}</td>")
+        body += f'<tr style="background-color: {colors[row["status"]]};">{"".join(cells)}</tr>\n'
+    generated_at = datetime.now(timezone.utc).strftime('%Y-%m-%d %H:%M UTC')
+    return f"""<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Tailnet policy scorecard</title></head>
+<body style="font-family: sans-serif; font-size: 13px;">
+<h2>Tailnet policy scorecard</h2>
+<table style="border-collapse: collapse;" border="1" cellpadding="4">
+<tr>{header}</tr>
+{body}</table>
+<p style="color: #888; font-size: 11px;">Generated {generated_at} by tailscale-network-topology-mapper {__version__}</p>
+</body>
+</html>
+"""
+
+
+def report_validation_errors(errors, lenient, fatal=()):
+    # With --lenient the invalid parts are skipped and only warned about;
+    # fatal errors stop the run either way
+    if lenient:
+        for message in errors:
+            warn(message)
+        errors = []
+    hint = "; run with --lenient to skip invalid rules and map the rest" if errors else ""
+    errors = list(errors) + list(fatal)
+    for message in errors:
+        print(f"Error: {message}")
+    if errors:
+        print(f"{len(errors)} problem(s) found{hint}")
+        exit(1)
+
+
+def main():
+    started = time.monotonic()
+    args = parse_args()
+
+    if args.inventory:
+        run_inventory(args.inventory, args.output_dir, args.config)
+    config = apply_env_config(load_config(args.config), os.environ)
+    if args.strict_variables:
+        config['strict_variables'] = True
+    settings = get_render_settings(args.preset, config)
+    if args.show_tag_owners:
+        settings['show_tag_owners'] = True
+    if args.show_derp:
+        settings['show_derp'] = True
+    if args.show_orphans:
+        settings['show_orphans'] = True
+    if args.wildcard_nodes:
+        settings['wildcard_nodes'] = True
+    node_colors.update(settings['colors'])
+    protocols.update(config.get('protocols', {}))
+
+    # Step 1: Parse the ACL File using json
+    if args.tailnet and args.policy:
+        print("Error: --tailnet and --policy can't be combined")
+        exit(1)
+    if args.tailnet:
+        policy_paths = [get_tailnet_api_url(args.tailnet, 'acl')]
+    else:
+        args.policy = args.policy or [os.environ.get('POLICY_FILE', 'policy.hujson')]
+        policy_paths = expand_policy_paths(args.policy)
+        credential_origins.update(get_url_origin(path) for path in policy_paths if path.startswith('https://'))
+    if not policy_paths:
+        print(f"Error: No .json or .hujson policy files found in {', '.join(args.policy)}")
+        exit(1)
+    acl_file_path = policy_paths[0]
+    loaded = load_policy_files(policy_paths, config)
+    if loaded is None:
+        print("Error: Could not parse ACL policy file")
+        exit(1)
+    acl_data, policy_sources, provenance = loaded
+    if len(policy_sources) > 1:
+        print(f"Merged {len(policy_sources) - 1} additional policy file(s)")
+
+    # Scanned before --anonymize rewrites the text; reported with the other
+    # lint findings
+    scan_findings = []
+    if args.scan:
+        for source, text in policy_sources.items():
+            scan_findings += [(check, message, source, line_number)
+                              for line_number, check, message in scan_policy(text, config.get('scan', {}))]
+    if args.anonymize:
+        anonymizer = new_anonymizer()
+        if isinstance(acl_data.get('hosts'), dict):
+            add_anonymized_hosts(anonymizer, acl_data['hosts'])
+        acl_data, policy_sources, provenance, source_labels = anonymize_policy(
+            anonymizer, acl_data, policy_sources, provenance)
+        acl_file_path = source_labels[acl_file_path]
+        scan_findings = [(check, anonymize_string(anonymizer, message), source_labels[source], line_number)
+                         for check, message, source, line_number in scan_findings]
+        args.focus = args.focus and anonymize_string(anonymizer, args.focus)
+        args.include = [anonymize_string(anonymizer, pattern) for pattern in args.include]
+        args.exclude = [anonymize_string(anonymizer, pattern) for pattern in args.exclude]
+        validation_config = config.get('validation', {})
+        if validation_config.get('allowed_domains'):
+            validation_config['allowed_domains'] = [anonymize_domain(anonymizer, domain)
+                                                    for domain in validation_config['allowed_domains']]
+
+    # Step 2: Extract Hosts, Groups, and Tag Owners
+    hosts = acl_data.get('hosts', {})
+    groups = acl_data.get('groups', {})
+    tag_owners = acl_data.get('tagOwners', {})
+
+    if args.export_group_members:
+        # Exporting skips validation, but members of a cycle are still worth
+        # a second look before they go into an access review
+        for cycle in find_group_cycles(groups):
+            warn(f"Circular group reference: {' -> '.join(cycle)}")
+        users = None
+        if args.tailnet or args.devices == 'api':
+            users = load_users(args.tailnet or '-', config)
+            if users is None:
+                warn("Could not fetch the tailnet's users; autogroup: members are exported as-is")
+        export_group_members(groups, args.export_group_members, users)
+        return
+
+    postures = acl_data.get('postures', {})
+    posture_problems = validate_postures(postures)
+    # Problems are collected and reported together after the rules are
+    # validated, so a single run lists everything that needs fixing
+    validation_errors = []
+    for posture, expression, reason in posture_problems:
+        expression = f" '{expression}'" if expression is not None else ""
+        validation_errors.append(f"Invalid posture {posture}{expression}: {reason}")
+    if args.schema_validate:
+        # Before validate_rules, which drops the invalid rules' locations
+        validation_errors += get_schema_errors(acl_data, policy_sources, provenance)
+    postures = {p: e for p, e in postures.items() if p not in {problem[0] for problem in posture_problems}}
+    if args.evaluate_postures:
+        report_validation_errors(validation_errors, args.lenient)
+        evaluate_postures(postures, args.evaluate_postures)
+        return
+    for cycle in find_group_cycles(groups):
+        validation_errors.append(f"Circular group reference: {' -> '.join(cycle)}")
+    # Invalid hosts are left out of the map, like invalid rules with --lenient
+    host_problems, hosts, networks = validate_hosts(hosts)
+    validation_errors += host_problems
+    network_hosts.update(networks)
+    ipsets = acl_data.get('ipsets', {})
+    for message in validate_ipsets(ipsets):
+        warn(message)
+    drift = []
+    if args.devices:
+        devices = load_devices(args.devices, args.tailnet, config)
+        if devices is None:
+            exit(1)
+        if args.anonymize:
+            add_anonymized_hosts(anonymizer, [device.get('hostname') for device in devices])
+            devices = anonymize_value(anonymizer, devices)
+        auto_approvers = acl_data.get('autoApprovers', {})
+        drift = find_policy_drift(tag_owners, auto_approvers if isinstance(auto_approvers, dict) else {}, devices)
+        for message in drift:
+            warn(f"Drift: {message}")
+    validation_config = config.get('validation', {})
+    domain_errors = []
+    if validation_config.get('allowed_domains'):
+        domain_problems = find_disallowed_members(groups, tag_owners, validation_config['allowed_domains'])
+        if validation_config.get('domain_violations', 'error') == 'warn':
+            for message in domain_problems:
+                warn(message)
+        else:
+            domain_errors = domain_problems
+
+    # Step 3: Extract ACL Rules
+    acls, skipped_rules = validate_rules('acls', acl_data.get('acls', []), policy_sources, provenance)
+    grants, skipped_grants = validate_rules('grants', acl_data.get('grants', []), policy_sources, provenance)
+    ssh_rules, skipped_ssh_rules = validate_rules('ssh', acl_data.get('ssh', []), policy_sources, provenance)
+    node_attrs, skipped_node_attrs = validate_rules('nodeAttrs', acl_data.get('nodeAttrs', []), policy_sources, provenance)
+    skipped_rules += skipped_grants + skipped_ssh_rules + skipped_node_attrs
+    validation_errors += [f"{description}: {'; '.join(problems)}" for description, problems in skipped_rules]
+    # --lenient can't wave through members from disallowed domains
+    report_validation_errors(validation_errors, args.lenient, fatal=domain_errors)
+    test_results = run_policy_tests(acl_data, acls, grants, ssh_rules, groups, hosts, policy_sources, provenance)
+    if args.run_tests:
+        for where, passed, message in test_results:
+            print(f"{'PASS' if passed else 'FAIL'} {where}: {message}")
+        failures = sum(1 for _, passed, _ in test_results if not passed)
+        print(f"{len(test_results) - failures} passed, {failures} failed")
+        exit(1 if failures else 0)
+    for where, passed, message in test_results:
+        if not passed:
+            warn(f"Policy test failed at {where}: {message}")
+    default_posture = acl_data.get('defaultSrcPosture', [])
+    if not isinstance(default_posture, list):
+        default_posture = []
+    redundant_acls = find_redundant_acls(acls, grants, groups, hosts, default_posture)
+    lint_config = config.get('lint', {})
+    lint_counts = report_lint_findings(
+        run_lint_checks(acl_data, acls, grants, groups, hosts, tag_owners, redundant_acls, policy_sources, provenance)
+        + [(check, f"{message} ({source}, line {line_number})") for check, message, source, line_number in scan_findings],
+        lint_config)
+    if args.remove_redundant_acls:
+        write_without_redundant_acls(args.remove_redundant_acls, redundant_acls, acl_file_path, policy_sources, provenance)
+        return
+    if args.convert_to_grants:
+        write_grants_conversion(args.convert_to_grants, acls, policy_sources, provenance)
+        return
+    if args.remove_rule:
+        print_rule_removal_impact(acl_file_path, acls, grants, args.remove_rule, groups, hosts, default_posture,
+                                  policy_sources, provenance)
+        return
+    rules_by_section = {'acls': acls, 'grants': grants, 'ssh': ssh_rules}
+    rule_expiries = get_rule_expiries(rules_by_section, policy_sources, provenance)
+    expiring_rules = check_rule_expiries(rule_expiries, policy_sources, provenance,
+                                         config.get('expiry', {}).get('warn_days', 30))
+    merged_acls = merge_acls(acls)
+    for merged_rule, expires in zip(merged_acls, rule_expiries['acls']):
+        if expires is not None:
+            merged_rule['expires'] = expires
+    # Rules without their own srcPosture get the policy's defaultSrcPosture
+    if default_posture:
+        for merged_rule in merged_acls:
+            merged_rule.setdefault('src_posture', default_posture)
+        grants = [grant if grant.get('srcPosture') else dict(grant, srcPosture=default_posture) for grant in grants]
+
+    # Step 4: Construct Network Topology Graph
+    graph = new_graph()
+    summaries = get_rule_summaries(merged_acls, grants, ssh_rules, config.get('summaries', {}))
+    add_acl_edges(graph, merged_acls, summaries['acls'])
+    add_grant_edges(graph, grants, summaries['grants'], rule_expiries['grants'])
+    add_ssh_edges(graph, ssh_rules, summaries['ssh'], rule_expiries['ssh'])
+    add_node_attrs(graph, node_attrs, hosts)
+    if settings['show_tag_owners']:
+        add_tag_owner_edges(graph, tag_owners)
+    if settings['show_derp']:
+        add_derp_nodes(graph, acl_data.get('derpMap', {}))
+    if settings['show_auto_approvers']:
+        add_auto_approver_edges(graph, *validate_auto_approvers(acl_data.get('autoApprovers', {})))
+    if settings['show_orphans']:
+        for section, name in find_unreferenced_definitions(acl_data):
+            if section != 'postures':
+                add_graph_node(graph, name)
+                graph['nodes'][name]['orphan'] = True
+    for node, attrs in graph['nodes'].items():
+        if get_node_type(node) == 'ipset' and isinstance(ipsets.get(node), list):
+            attrs['title'] = f"{node}\n" + "\n".join(str(entry) for entry in ipsets[node])
+    graph = merge_graph_nodes(graph, config.get('merge', []))
+    filters = config.get('filters', {})
+    include = filters.get('include', []) + args.include
+    exclude = filters.get('exclude', []) + args.exclude
+    if include or exclude:
+        graph = filter_graph(graph, include, exclude)
+    if args.focus:
+        if args.focus not in graph['nodes']:
+            print(f"Error: Focus node '{args.focus}' is not in the graph")
+            exit(1)
+        graph = focus_graph(graph, args.focus, args.depth)
+    limits = config.get('limits', {})
+    graph = apply_graph_limits(graph, limits)
+    add_definition_locations(graph, policy_sources, provenance)
+    # Redacted last, so filters, --focus and merges still use the real names
+    redactions = get_redactions(graph, config.get('redact', []) + args.redact)
+    graph = redact_graph(graph, redactions)
+
+    net = Network(height="800px", width="100%", notebook=True, directed=True, filter_menu=True,select_menu=True,neighborhood_highlight=True, cdn_resources='remote',
+                  layout=True if settings['layout'] == 'hierarchical' else None)
+    render_graph(net, graph, settings)
+    rule_collections = get_rule_collections(rules_by_section, config.get('collections', {}), acl_file_path,
+                                            policy_sources, provenance)
+    collection_names = assign_node_collections(net, dict(rules_by_section, acls=merged_acls), rule_collections)
+    apply_layout_pins(net, config.get('layout', {}).get('pins', {}), settings)
+
+    # Step 5: Add a legend for the colors
+    stats = compute_policy_stats(acls, grants, ssh_rules, hosts, groups, tag_owners, config.get('stats', {}))
+    stats['ipsets'] = len(ipsets)
+    stats['policy_hash'] = hash_policy(acl_data)
+    stats['graph_hash'] = hash_graph(graph)
+    legend_html = build_legend_html(settings, redact_value(stats, redactions))
+
+    # Inject the legend HTML into the network visualization
+    if settings['show_buttons']:
+        net.show_buttons()
+    os.makedirs(args.output_dir, exist_ok=True)
+    output_path = os.path.join(args.output_dir, "network_topology.html")
+    net.write_html(output_path)
+    with open(output_path, "a") as f:
+        f.write(legend_html)
+        f.write(build_skipped_rules_html(redact_value(skipped_rules, redactions)))
+        f.write(build_drift_html(redact_value(drift, redactions)))
+        f.write(build_controls_html(collection_names, args.focus, args.depth))
+        f.write(build_rules_table_html(redact_value(get_rule_table_rows(
+            acls, merged_acls, grants, ssh_rules, summaries, policy_sources, provenance), redactions)))
+        f.write(build_footer_html())
+    html_mb = os.path.getsize(output_path) / (1024 * 1024)
+    if html_mb > limits.get('max_html_mb', 50):
+        warn(f"{output_path} is {html_mb:.1f} MB, which browsers may struggle to open; "
+             f"use --include, --exclude or --focus to map less at once")
+
+    if args.export_drawio:
+        export_drawio(net, args.export_drawio)
+    badge_paths = write_badges(os.path.join(args.output_dir, "badges"), stats, lint_counts) if args.badges else []
+
+    print_policy_stats(stats)
+    if skipped_rules:
+        print(f"{len(skipped_rules)} invalid rule(s) skipped")
+    for description, expires in expiring_rules:
+        print(f"{description} expires on {expires.isoformat()}")
+
+    audit_log = args.audit_log or config.get('audit_log')
+    if audit_log:
+        output_paths = [output_path] + ([args.export_drawio] if args.export_drawio else []) + badge_paths
+        append_audit_log(audit_log, {
+            'timestamp': datetime.now(timezone.utc).isoformat(),
+            'policy': acl_file_path,
+            'policy_sha256': hash_policy_sources(policy_sources),
+            'stats': stats,
+            'warnings': run_warnings,
+            'skipped_rules': len(skipped_rules),
+            'lint_findings': lint_counts,
+            'expiring_rules': [{'rule': description, 'expires': expires.isoformat()}
+                               for description, expires in expiring_rules],
+            'duration_seconds': round(time.monotonic() - started, 3),
+            'outputs': output_paths,
+            'version': __version__,
+        })
+
+    # as_uri() takes care of drive letters, backslashes and UNC shares (file://server/share/...)
+    print(f"Open in browser: {pathlib.Path(output_path).resolve().as_uri()}")
+    fail_on = args.fail_on or lint_config.get('fail_on')
+    if fail_on not in (None, 'warning', 'error'):
+        print(f"Error: lint fail_on must be \"warning\" or \"error\", got {json.dumps(fail_on)}")
+        exit(1)
+    if fail_on and set(lint_counts) & set(LINT_SEVERITIES[LINT_SEVERITIES.index(fail_on):]):
+        print(f"Lint findings at or above '{fail_on}' severity; exiting with an error")
+        exit(1)
+
+
+if __name__ == "__main__":
+    main()
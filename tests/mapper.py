@@ -0,0 +1,10 @@
+import importlib.util
+import os
+
+# create-network-map.py can't be imported by name because of the dashes, so
+# the tests load it from its path
+SCRIPT = os.path.join(os.path.dirname(os.path.dirname(os.path.abspath(__file__))), 'create-network-map.py')
+
+spec = importlib.util.spec_from_file_location('create_network_map', SCRIPT)
+mapper = importlib.util.module_from_spec(spec)
+spec.loader.exec_module(mapper)
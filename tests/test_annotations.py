@@ -0,0 +1,89 @@
+import unittest
+from contextlib import redirect_stdout
+from datetime import date
+from io import StringIO
+
+from mapper import mapper
+
+POLICY = """// collection: Not a rule
+{
+  "acls": [
+    {"action": "accept", "src": ["group:eng"], "dst": ["tag:db:5432"]},
+    // collection: Databases
+    {"action": "accept", "src": ["group:dba"], "dst": ["tag:db:*"]},
+  ],
+  "grants": [
+    // collection: CI
+    {"src": ["tag:ci"], "dst": ["tag:build"], "ip": ["443"]},
+    {"src": ["group:ops"], "dst": ["tag:web"], "ip": ["80"]},
+  ],
+  "ssh": [
+    {"action": "accept", "src": ["group:ops"], "dst": ["tag:web"], "users": ["root"]},
+  ],
+}
+"""
+
+
+def load(text):
+    policy = mapper.load_json_or_hujson_text(text, 'policy.hujson')
+    sources = {'policy.hujson': text}
+    provenance = {section: [('policy.hujson', position) for position in range(len(policy[section]))]
+                  for section in ('acls', 'grants', 'ssh')}
+    rules_by_section = {section: policy[section] for section in ('acls', 'grants', 'ssh')}
+    return rules_by_section, sources, provenance
+
+
+class RuleCollectionsTest(unittest.TestCase):
+    def test_comments_in_every_section(self):
+        rules_by_section, sources, provenance = load(POLICY)
+        collections = mapper.get_rule_collections(rules_by_section, {}, 'policy.hujson', sources, provenance)
+        self.assertEqual(collections, {'acls': [None, 'Databases'], 'grants': ['CI', None], 'ssh': [None]})
+
+    def test_config_patterns(self):
+        rules_by_section, sources, provenance = load(POLICY)
+        config = {'Web': {'dst': ['tag:web']}}
+        collections = mapper.get_rule_collections(rules_by_section, config, 'policy.hujson', sources, provenance)
+        self.assertEqual(collections['grants'], ['CI', 'Web'])
+        self.assertEqual(collections['ssh'], ['Web'])
+
+
+EXPIRING_POLICY = """// expires: 2020-01-01
+{
+  "acls": [
+    {"action": "accept", "src": ["group:eng"], "dst": ["tag:db:5432"]},
+  ],
+  "grants": [
+    // expires: 2020-01-01
+    {"src": ["tag:ci"], "dst": ["tag:build"], "ip": ["443"]},
+    {"src": ["group:ops"], "dst": ["tag:web"], "ip": ["80"]}, // expires:2099-12-31
+  ],
+  "ssh": [
+    // expires: 2099-12-31
+    {"action": "accept", "src": ["group:ops"], "dst": ["tag:web"], "users": ["root"]},
+  ],
+}
+"""
+
+
+class RuleExpiriesTest(unittest.TestCase):
+    def test_every_section(self):
+        rules_by_section, sources, provenance = load(EXPIRING_POLICY)
+        expiries = mapper.get_rule_expiries(rules_by_section, sources, provenance)
+        self.assertEqual(expiries, {
+            'acls': [None],
+            'grants': [date(2020, 1, 1), date(2099, 12, 31)],
+            'ssh': [date(2099, 12, 31)],
+        })
+
+    def test_expired_and_upcoming(self):
+        rules_by_section, sources, provenance = load(EXPIRING_POLICY)
+        expiries = mapper.get_rule_expiries(rules_by_section, sources, provenance)
+        with redirect_stdout(StringIO()) as output:
+            upcoming = mapper.check_rule_expiries(expiries, sources, provenance, 365 * 100)
+        self.assertIn("Grant #0 (policy.hujson, line 8) expired on 2020-01-01", output.getvalue())
+        self.assertEqual([description for description, _ in upcoming],
+                         ["Grant #1 (policy.hujson, line 9)", "SSH rule #0 (policy.hujson, line 13)"])
+
+
+if __name__ == '__main__':
+    unittest.main()
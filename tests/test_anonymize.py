@@ -0,0 +1,52 @@
+import os
+import sys
+import tempfile
+import unittest
+from contextlib import redirect_stdout
+from io import StringIO
+from unittest import mock
+
+from mapper import mapper
+
+POLICY = """{
+  "groups": {"group:eng": ["alice@acme-corp.com"]},
+  "hosts": {"db": "100.64.0.10"},
+  "acls": [
+    {"action": "accept", "src": ["group:eng"], "dst": ["db:5432"]},
+  ],
+}
+"""
+
+
+class AnonymizePolicyTest(unittest.TestCase):
+    def test_sources_are_relabeled(self):
+        anonymizer = mapper.new_anonymizer()
+        sources = {'/srv/acme-corp.com/policy.hujson': POLICY, '/srv/acme-corp.com/extra.hujson': '{}'}
+        provenance = {'hosts': {'db': '/srv/acme-corp.com/policy.hujson'},
+                      'acls': [('/srv/acme-corp.com/extra.hujson', 0)]}
+        _, sources, provenance, labels = mapper.anonymize_policy(anonymizer, {}, sources, provenance)
+        self.assertEqual(list(sources), ['source-1', 'source-2'])
+        self.assertEqual(provenance['acls'], [('source-2', 0)])
+        self.assertEqual(list(provenance['hosts'].values()), ['source-1'])
+        self.assertEqual(labels['/srv/acme-corp.com/policy.hujson'], 'source-1')
+
+    def test_rendered_map_has_no_policy_path(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            policy_dir = os.path.join(tmp, 'acme-corp.com')
+            os.mkdir(policy_dir)
+            policy_path = os.path.join(policy_dir, 'policy.hujson')
+            with open(policy_path, 'w') as f:
+                f.write(POLICY)
+            output_dir = os.path.join(tmp, 'out')
+            argv = ['create-network-map.py', '--policy', policy_path, '--anonymize', '--output-dir', output_dir]
+            with mock.patch.object(sys, 'argv', argv), mock.patch.dict(os.environ, {}, clear=True), \
+                    redirect_stdout(StringIO()):
+                mapper.main()
+            with open(os.path.join(output_dir, 'network_topology.html')) as f:
+                html = f.read()
+        self.assertNotIn('acme-corp.com', html)
+        self.assertIn('source-1', html)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,34 @@
+import os
+import tempfile
+import unittest
+
+from mapper import mapper
+
+
+class ReadLastAuditRecordTest(unittest.TestCase):
+    def read(self, text):
+        with tempfile.TemporaryDirectory() as tmp:
+            path = os.path.join(tmp, 'audit.jsonl')
+            with open(path, 'w') as f:
+                f.write(text)
+            return mapper.read_last_audit_record(path)
+
+    def test_last_record(self):
+        self.assertEqual(self.read('{"run": 1}\n{"run": 2}\n'), {'run': 2})
+
+    def test_trailing_blank_lines(self):
+        self.assertEqual(self.read('{"run": 1}\n\n  \n'), {'run': 1})
+
+    def test_half_written_record(self):
+        self.assertEqual(self.read('{"run": 1}\n{"run": 2, "sta'), {'run': 1})
+
+    def test_no_records(self):
+        self.assertIsNone(self.read(''))
+        self.assertIsNone(self.read('\n\n'))
+
+    def test_missing_log(self):
+        self.assertIsNone(mapper.read_last_audit_record(os.path.join(tempfile.gettempdir(), 'no-such-audit.jsonl')))
+
+
+if __name__ == '__main__':
+    unittest.main()
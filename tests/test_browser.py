@@ -0,0 +1,130 @@
+import os
+import sys
+import tempfile
+import unittest
+from contextlib import redirect_stdout
+from io import StringIO
+from unittest import mock
+
+from mapper import mapper
+
+try:
+    from playwright.sync_api import sync_playwright
+except ImportError:
+    sync_playwright = None
+
+# These drive the generated map in a real browser, so they need Playwright
+# (pip install playwright && playwright install chromium) and network access
+# for the vis.js bundle the map loads. They only run with BROWSER_TESTS=1.
+ENABLED = bool(os.environ.get('BROWSER_TESTS')) and sync_playwright is not None
+
+POLICY = """{
+  "groups": {"group:eng": ["alice@example.com"], "group:ops": ["bob@example.com"]},
+  "hosts": {"db": "100.64.0.10"},
+  "tagOwners": {"tag:ci": ["group:ops"], "tag:build": ["group:ops"], "tag:web": ["group:ops"]},
+  "acls": [
+    {"action": "accept", "src": ["group:eng"], "dst": ["db:5432"]},
+    {"action": "accept", "src": ["group:ops"], "dst": ["tag:web:80,443"]},
+    // collection: CI
+    {"action": "accept", "src": ["tag:ci"], "dst": ["tag:build:22"]},
+  ],
+}
+"""
+
+
+@unittest.skipUnless(ENABLED, "set BROWSER_TESTS=1 and install Playwright to run the browser tests")
+class GeneratedMapTest(unittest.TestCase):
+    @classmethod
+    def setUpClass(cls):
+        cls.tmp = tempfile.TemporaryDirectory()
+        policy_path = os.path.join(cls.tmp.name, 'policy.hujson')
+        with open(policy_path, 'w') as f:
+            f.write(POLICY)
+        argv = ['create-network-map.py', '--policy', policy_path, '--output-dir', cls.tmp.name]
+        with mock.patch.object(sys, 'argv', argv), mock.patch.dict(os.environ, {}, clear=True), \
+                redirect_stdout(StringIO()):
+            mapper.main()
+        cls.url = 'file://' + os.path.join(cls.tmp.name, 'network_topology.html')
+        cls.playwright = sync_playwright().start()
+        cls.browser = cls.playwright.chromium.launch()
+
+    @classmethod
+    def tearDownClass(cls):
+        cls.browser.close()
+        cls.playwright.stop()
+        cls.tmp.cleanup()
+
+    def setUp(self):
+        self.page = self.browser.new_page()
+        errors = []
+        self.page.on('pageerror', lambda error: errors.append(str(error)))
+        self.page.goto(self.url)
+        self.page.wait_for_function("typeof network !== 'undefined' && document.querySelector('#rule-table tbody tr')")
+        # Physics would keep moving the nodes under the mouse
+        self.page.evaluate("network.setOptions({physics: false})")
+        self.addCleanup(self.page.close)
+        self.addCleanup(lambda: self.assertEqual(errors, []))
+
+    def visible_nodes(self):
+        return sorted(self.page.evaluate(
+            "nodes.get({filter: function (n) { return !n.hidden; }}).map(function (n) { return n.id; })"))
+
+    def rule_rows(self):
+        return [row.inner_text().split('\t') for row in self.page.query_selector_all('#rule-table tbody tr')]
+
+    def test_rule_table_filter(self):
+        self.assertEqual(len(self.rule_rows()), 3)
+        self.page.fill('#rule-filter', 'tag:web')
+        rows = self.rule_rows()
+        self.assertEqual(len(rows), 1)
+        self.assertEqual(rows[0][2], 'group:ops')
+
+    def test_rule_table_sort(self):
+        self.page.click('#rule-table th:has-text("Source")')
+        self.assertEqual([row[2] for row in self.rule_rows()], ['group:eng', 'group:ops', 'tag:ci'])
+        self.page.click('#rule-table th:has-text("Source")')
+        self.assertEqual([row[2] for row in self.rule_rows()], ['tag:ci', 'group:ops', 'group:eng'])
+
+    def test_focus_search(self):
+        self.page.evaluate("network.openCluster('collection:CI')")
+        self.page.fill('#focus-node', 'group:eng')
+        self.page.fill('#focus-depth', '1')
+        self.page.click('button:text-is("Focus")')
+        self.assertEqual(self.visible_nodes(), ['db', 'group:eng'])
+        self.page.click('button:text-is("Show all")')
+        self.assertNotIn(True, self.page.evaluate("nodes.get().map(function (n) { return !!n.hidden; })"))
+
+    def test_collection_toggle(self):
+        self.assertTrue(self.page.evaluate("network.isCluster('collection:CI')"))
+        self.page.click('button:text-is("CI")')
+        self.assertFalse(self.page.evaluate("network.isCluster('collection:CI')"))
+        self.page.click('button:text-is("CI")')
+        self.assertTrue(self.page.evaluate("network.isCluster('collection:CI')"))
+
+    def test_legend_stats_toggle(self):
+        details = self.page.query_selector('details')
+        self.assertFalse(details.evaluate("element => element.open"))
+        self.page.click('summary:has-text("Policy stats")')
+        self.assertTrue(details.evaluate("element => element.open"))
+
+    def test_node_click(self):
+        # Centered first so the legend and panels drawn over the map aren't in
+        # the way
+        self.page.evaluate("network.focus('db', {scale: 1, animation: false})")
+        canvas = self.page.query_selector('#mynetwork canvas').bounding_box()
+        position = self.page.evaluate("network.canvasToDOM(network.getPositions(['db']).db)")
+        self.page.mouse.click(canvas['x'] + position['x'], canvas['y'] + position['y'])
+        self.assertEqual(self.page.evaluate("network.getSelectedNodes()"), ['db'])
+
+    def test_edge_selection_highlights_rules(self):
+        self.page.evaluate("""(function () {
+            var edge = edges.get({filter: function (e) { return e.from === 'group:ops'; }})[0];
+            network.selectEdges([edge.id]);
+            network.body.emitter.emit('selectEdge', {nodes: [], edges: [edge.id]});
+        })()""")
+        selected = self.page.query_selector_all('#rule-table tr.selected-rule')
+        self.assertEqual([row.inner_text().split('\t')[2] for row in selected], ['group:ops'])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,58 @@
+import unittest
+
+from mapper import mapper
+
+
+def acl(dst, **fields):
+    return dict({'action': 'accept', 'src': ['group:eng'], 'dst': dst}, **fields)
+
+
+class ConvertAclToGrantsTest(unittest.TestCase):
+    def test_simple_rule(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['tag:web:80,443', 'tag:api:80,443']))
+        self.assertEqual(grants, [{'src': ['group:eng'], 'dst': ['tag:web', 'tag:api'], 'ip': ['80,443']}])
+        self.assertEqual(notes, [])
+
+    def test_all_ports(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['*:*']))
+        self.assertEqual(grants, [{'src': ['group:eng'], 'dst': ['*'], 'ip': ['*']}])
+        self.assertEqual(notes, [])
+
+    def test_split_by_ports(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['tag:web:443', 'tag:db:5432', 'tag:api:443']))
+        self.assertEqual(grants, [
+            {'src': ['group:eng'], 'dst': ['tag:web', 'tag:api'], 'ip': ['443']},
+            {'src': ['group:eng'], 'dst': ['tag:db'], 'ip': ['5432']},
+        ])
+        self.assertEqual(len(notes), 1)
+        self.assertIn("split into 2 grants", notes[0])
+
+    def test_proto(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['tag:dns:53'], proto='tcp,udp'))
+        self.assertEqual(grants[0]['ip'], ['tcp:53', 'udp:53'])
+        self.assertEqual(len(notes), 1)
+
+    def test_proto_without_grant_name_becomes_number(self):
+        grants, _ = mapper.convert_acl_to_grants(acl(['tag:vpn:*'], proto='gre'))
+        self.assertEqual(grants[0]['ip'], ['47:*'])
+
+    def test_src_posture_is_kept(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['tag:web:443'], srcPosture=['posture:corp']))
+        self.assertEqual(grants[0]['srcPosture'], ['posture:corp'])
+        self.assertEqual(notes, [])
+
+    def test_unknown_fields_are_dropped(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['tag:web:443'], remark="legacy"))
+        self.assertNotIn('remark', grants[0])
+        self.assertEqual(notes, ["field 'remark' has no grant equivalent and was dropped"])
+
+    def test_ipv6_address_port_is_flagged(self):
+        grants, notes = mapper.convert_acl_to_grants(acl(['fd7a:115c::1:22']))
+        self.assertEqual(grants[0]['dst'], ['fd7a:115c::1'])
+        self.assertEqual(len(notes), 1)
+        _, notes = mapper.convert_acl_to_grants(acl(['[fd7a:115c::1]:22', 'fd7a:115c::/48:22']))
+        self.assertEqual(notes, [])
+
+
+if __name__ == '__main__':
+    unittest.main()
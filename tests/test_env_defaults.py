@@ -0,0 +1,59 @@
+import unittest
+from contextlib import redirect_stderr
+from io import StringIO
+
+from mapper import mapper
+
+
+class ParseArgsEnvironmentTest(unittest.TestCase):
+    def test_switch_and_value(self):
+        args = mapper.parse_args([], {'TSMAP_SCAN': 'yes', 'TSMAP_DEPTH': '3', 'TSMAP_LENIENT': '0'})
+        self.assertTrue(args.scan)
+        self.assertEqual(args.depth, 3)
+        self.assertFalse(args.lenient)
+
+    def test_command_line_wins_over_value(self):
+        args = mapper.parse_args(['--output-dir', 'cli'], {'TSMAP_OUTPUT_DIR': 'env'})
+        self.assertEqual(args.output_dir, 'cli')
+
+    def test_list_from_environment(self):
+        args = mapper.parse_args([], {'TSMAP_POLICY': 'a.hujson, b.hujson', 'TSMAP_EXCLUDE': 'tag:ci'})
+        self.assertEqual(args.policy, ['a.hujson', 'b.hujson'])
+        self.assertEqual(args.exclude, ['tag:ci'])
+
+    def test_command_line_replaces_list(self):
+        args = mapper.parse_args(['--policy', 'cli.hujson', '--exclude', 'tag:prod'],
+                                 {'TSMAP_POLICY': 'env.hujson', 'TSMAP_EXCLUDE': 'tag:ci'})
+        self.assertEqual(args.policy, ['cli.hujson'])
+        self.assertEqual(args.exclude, ['tag:prod'])
+
+    def test_list_defaults_without_environment(self):
+        args = mapper.parse_args([], {})
+        self.assertIsNone(args.policy)
+        self.assertEqual(args.include, [])
+        self.assertEqual(args.redact, [])
+
+    def test_invalid_value_names_variable(self):
+        stderr = StringIO()
+        with redirect_stderr(stderr), self.assertRaises(SystemExit):
+            mapper.parse_args([], {'TSMAP_DEPTH': 'deep'})
+        self.assertIn('TSMAP_DEPTH', stderr.getvalue())
+
+
+class ApplyEnvConfigTest(unittest.TestCase):
+    def test_nested_keys_and_json_values(self):
+        config = mapper.apply_env_config({'render': {'physics': True}}, {
+            'TSMAP_CONFIG__RENDER__LAYOUT': 'hierarchical',
+            'TSMAP_CONFIG__LINT__WILDCARD': '"off"',
+            'TSMAP_CONFIG__COLLECTIONS': '{"prod": ["tag:prod"]}',
+            'TSMAP_OUTPUT_DIR': 'ignored',
+        })
+        self.assertEqual(config, {
+            'render': {'physics': True, 'layout': 'hierarchical'},
+            'lint': {'wildcard': 'off'},
+            'collections': {'prod': ['tag:prod']},
+        })
+
+
+if __name__ == '__main__':
+    unittest.main()
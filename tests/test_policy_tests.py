@@ -0,0 +1,73 @@
+import unittest
+
+from mapper import mapper
+
+GROUPS = {'group:eng': ['alice@example.com']}
+HOSTS = {'db': '100.64.0.10'}
+ACLS = [{'action': 'accept', 'src': ['group:eng'], 'dst': ['db:5432']}]
+SSH_RULES = [{'action': 'check', 'src': ['group:eng'], 'dst': ['tag:web'], 'users': ['root']}]
+
+
+def run(policy, acls=ACLS, grants=(), ssh_rules=SSH_RULES):
+    return mapper.run_policy_tests(policy, acls, list(grants), ssh_rules, GROUPS, HOSTS, {}, {})
+
+
+class ValidatePolicyTestTest(unittest.TestCase):
+    def test_valid(self):
+        self.assertEqual(mapper.validate_policy_test({'src': 'alice@example.com', 'accept': ['db:5432']}, 'tests'), [])
+        self.assertEqual(mapper.validate_policy_test(
+            {'src': 'alice@example.com', 'dst': ['tag:web'], 'check': ['root']}, 'sshTests'), [])
+
+    def test_problems(self):
+        self.assertEqual(mapper.validate_policy_test('alice', 'tests'), ["test is not an object"])
+        self.assertEqual(mapper.validate_policy_test({'accept': 'db:22'}, 'tests'),
+                         ["src must be a non-empty string", "accept must be a list of strings"])
+        self.assertEqual(mapper.validate_policy_test({'src': 'a@example.com', 'deny': ['db:22-23']}, 'tests'),
+                         ["deny 'db:22-23' must name a single port"])
+        self.assertEqual(mapper.validate_policy_test({'src': 'a@example.com', 'dst': 'tag:web'}, 'sshTests'),
+                         ["dst must be a list of strings"])
+
+    def test_unknown_proto(self):
+        problems = mapper.validate_policy_test({'src': 'a@example.com', 'proto': 'nope'}, 'tests')
+        self.assertEqual(len(problems), 1)
+        self.assertIn("unknown proto 'nope'", problems[0])
+
+
+class RunPolicyTestsTest(unittest.TestCase):
+    def test_accept_and_deny(self):
+        results = run({'tests': [{'src': 'alice@example.com', 'accept': ['db:5432'], 'deny': ['db:22']}]})
+        self.assertEqual([passed for _, passed, _ in results], [True, True])
+        self.assertEqual(results[0][0], "tests #0")
+
+    def test_failure(self):
+        results = run({'tests': [{'src': 'alice@example.com', 'accept': ['db:22']}]})
+        self.assertEqual(results, [("tests #0", False, "alice@example.com -> db:22 should be allowed, "
+                                                       "not allowed by any rule")])
+
+    def test_proto(self):
+        acls = [dict(ACLS[0], proto='udp')]
+        results = run({'tests': [{'src': 'alice@example.com', 'proto': 'udp', 'accept': ['db:5432']},
+                                 {'src': 'alice@example.com', 'deny': ['db:5432']}]}, acls)
+        self.assertEqual([passed for _, passed, _ in results], [True, True])
+
+    def test_grants(self):
+        grants = [{'src': ['group:eng'], 'dst': ['db'], 'ip': ['tcp:22']}]
+        results = run({'tests': [{'src': 'alice@example.com', 'accept': ['db:22']}]}, grants=grants)
+        self.assertEqual([passed for _, passed, _ in results], [True])
+
+    def test_ssh(self):
+        results = run({'sshTests': [{'src': 'alice@example.com', 'dst': ['tag:web'], 'check': ['root'],
+                                     'deny': ['admin']}]})
+        self.assertEqual([passed for _, passed, _ in results], [True, True])
+        results = run({'sshTests': [{'src': 'alice@example.com', 'dst': ['tag:web'], 'accept': ['root']}]})
+        self.assertEqual(results, [("sshTests #0", False, "alice@example.com -> root@tag:web should be allowed, "
+                                                          "checked by SSH rule #0")])
+
+    def test_malformed_tests_fail(self):
+        results = run({'tests': [{'src': 'alice@example.com', 'accept': ['db:1-2']}], 'sshTests': {}})
+        self.assertEqual(results, [("sshTests", False, "sshTests must be a list"),
+                                   ("tests #0", False, "accept 'db:1-2' must name a single port")])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,70 @@
+import unittest
+
+from mapper import mapper
+
+
+class ParsePostureExpressionTest(unittest.TestCase):
+    def test_comparison(self):
+        self.assertEqual(mapper.parse_posture_expression("node:tsVersion >= '1.40'"), ('node:tsVersion', '>=', '1.40'))
+        self.assertEqual(mapper.parse_posture_expression('node:os == macos'), ('node:os', '==', 'macos'))
+
+    def test_list(self):
+        self.assertEqual(mapper.parse_posture_expression("node:os IN ['macos', \"windows\"]"),
+                         ('node:os', 'IN', ['macos', 'windows']))
+        self.assertEqual(mapper.parse_posture_expression("node:os NOT IN ['linux']"), ('node:os', 'NOT IN', ['linux']))
+
+    def test_quoted_comma_in_list(self):
+        self.assertEqual(mapper.parse_posture_expression("custom:tag IN ['a,b', 'c']"),
+                         ('custom:tag', 'IN', ['a,b', 'c']))
+
+    def test_set(self):
+        self.assertEqual(mapper.parse_posture_expression('node:tsReleaseTrack IS SET'),
+                         ('node:tsReleaseTrack', 'IS SET', None))
+        self.assertEqual(mapper.parse_posture_expression('node:tsReleaseTrack NOT SET'),
+                         ('node:tsReleaseTrack', 'NOT SET', None))
+
+    def test_malformed(self):
+        for expression, reason in [
+            ("macos", "expected '<attribute> <operator> <value>'"),
+            ("node:os IS SET 'macos'", "IS SET does not take a value"),
+            ("node:os ==", "== needs a value"),
+            ("node:os IN 'macos'", "IN needs a list"),
+            ("node:os == ['macos']", "== compares against a single value"),
+            ("node:os == mac os", "can't parse value 'mac os'"),
+        ]:
+            with self.subTest(expression=expression):
+                with self.assertRaises(ValueError) as raised:
+                    mapper.parse_posture_expression(expression)
+                self.assertIn(reason, str(raised.exception))
+
+
+class EvaluatePostureExpressionTest(unittest.TestCase):
+    ATTRIBUTES = {'node:os': 'macos', 'node:tsVersion': '1.62.0', 'node:tsAutoUpdate': True}
+
+    def evaluate(self, expression):
+        return mapper.evaluate_posture_expression(mapper.parse_posture_expression(expression), self.ATTRIBUTES)
+
+    def test_equality_and_lists(self):
+        self.assertTrue(self.evaluate("node:os == 'macos'"))
+        self.assertTrue(self.evaluate("node:os != 'linux'"))
+        self.assertTrue(self.evaluate("node:os IN ['macos', 'windows']"))
+        self.assertFalse(self.evaluate("node:os NOT IN ['macos']"))
+
+    def test_versions_compare_numerically(self):
+        self.assertTrue(self.evaluate("node:tsVersion >= '1.40'"))
+        self.assertTrue(self.evaluate("node:tsVersion > '1.9'"))
+        self.assertFalse(self.evaluate("node:tsVersion < '1.62'"))
+        self.assertTrue(self.evaluate("node:tsVersion <= '1.62.0'"))
+
+    def test_booleans_compare_as_lowercase(self):
+        self.assertTrue(self.evaluate("node:tsAutoUpdate == true"))
+
+    def test_missing_attribute(self):
+        self.assertFalse(self.evaluate("node:tsReleaseTrack == 'stable'"))
+        self.assertFalse(self.evaluate("node:tsReleaseTrack != 'stable'"))
+        self.assertTrue(self.evaluate("node:tsReleaseTrack NOT SET"))
+        self.assertTrue(self.evaluate("node:os IS SET"))
+
+
+if __name__ == '__main__':
+    unittest.main()
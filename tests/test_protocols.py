@@ -0,0 +1,69 @@
+import unittest
+from unittest import mock
+
+from mapper import mapper
+
+
+class ResolveProtocolTest(unittest.TestCase):
+    def test_names_and_aliases(self):
+        self.assertEqual(mapper.resolve_protocol('tcp'), ('tcp', 6))
+        self.assertEqual(mapper.resolve_protocol('UDP'), ('udp', 17))
+        self.assertEqual(mapper.resolve_protocol('ip-in-ip'), ('ipv4', 4))
+
+    def test_numbers(self):
+        self.assertEqual(mapper.resolve_protocol('47'), ('gre', 47))
+        self.assertEqual(mapper.resolve_protocol('112'), ('112', 112))
+
+    def test_unknown(self):
+        for proto in ('nope', '256', ''):
+            with self.subTest(proto=proto):
+                with self.assertRaises(ValueError):
+                    mapper.resolve_protocol(proto)
+        with self.assertRaises(ValueError):
+            mapper.resolve_protocol(6)
+
+    def test_config_additions(self):
+        with mock.patch.dict(mapper.protocols, {'vrrp': 112, 'ipip': 'ipv4'}):
+            self.assertEqual(mapper.resolve_protocol('vrrp'), ('vrrp', 112))
+            self.assertEqual(mapper.resolve_protocol('ipip'), ('ipv4', 4))
+            self.assertEqual(mapper.resolve_protocol('112'), ('vrrp', 112))
+
+    def test_alias_cycle(self):
+        with mock.patch.dict(mapper.protocols, {'a': 'b', 'b': 'a'}):
+            with self.assertRaises(ValueError):
+                mapper.resolve_protocol('a')
+
+
+class ResolveProtocolsTest(unittest.TestCase):
+    def test_single(self):
+        self.assertEqual(mapper.resolve_protocols('tcp'), [('tcp', 6)])
+
+    def test_comma_separated(self):
+        self.assertEqual(mapper.resolve_protocols('tcp, udp,47'), [('tcp', 6), ('udp', 17), ('gre', 47)])
+
+    def test_empty_entry(self):
+        for proto in ('tcp,', ',udp', 'tcp,,udp'):
+            with self.subTest(proto=proto):
+                with self.assertRaises(ValueError):
+                    mapper.resolve_protocols(proto)
+
+
+    def test_array(self):
+        self.assertEqual(mapper.resolve_protocols(['tcp', ' udp ']), [('tcp', 6), ('udp', 17)])
+
+    def test_bad_array(self):
+        for proto in ([], ['tcp', 6], ['tcp', ''], {'tcp': True}):
+            with self.subTest(proto=proto):
+                with self.assertRaises(ValueError):
+                    mapper.resolve_protocols(proto)
+
+    def test_acl_rule_with_array(self):
+        rule = {'action': 'accept', 'src': ['*'], 'dst': ['db:53'], 'proto': ['tcp', 'udp']}
+        self.assertEqual(mapper.validate_acl_rule(rule), [])
+        self.assertEqual(mapper.merge_acls([rule])[0]['proto'], [('tcp', 6), ('udp', 17)])
+        self.assertEqual(mapper.validate_acl_rule(dict(rule, proto=[])),
+                         ["proto must be a string or a non-empty list of strings"])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,112 @@
+import os
+import tempfile
+import unittest
+from contextlib import redirect_stdout
+from io import StringIO
+
+from mapper import mapper
+
+GROUPS = {'group:eng': ['alice@example.com', 'bob@example.com']}
+HOSTS = {'db': '100.64.0.10'}
+
+POLICY = """{
+  "acls": [
+    // Kept until the grants are rolled out
+    {"action": "accept", "src": ["group:eng"], "dst": ["db:5432"]},
+    {
+      "action": "accept",
+      "src": ["group:eng"],
+      "dst": ["tag:web:80,443"],
+    },
+    {"action": "accept", "src": ["*"], "dst": ["tag:ci:22"]}, {"action": "accept", "src": ["*"], "dst": ["tag:ci:80"]},
+  ],
+}
+"""
+
+
+def acl(dst, **fields):
+    return dict({'action': 'accept', 'src': ['group:eng'], 'dst': dst}, **fields)
+
+
+def grant(dst, ip, **fields):
+    return dict({'src': ['group:eng'], 'dst': dst, 'ip': ip}, **fields)
+
+
+class FindRedundantAclsTest(unittest.TestCase):
+    def test_covered_by_grant(self):
+        acls = [acl(['db:5432'])]
+        grants = [grant(['100.64.0.10'], ['5432'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [(0, [0])])
+
+    def test_covered_by_several_grants(self):
+        acls = [acl(['tag:web:80,443'])]
+        grants = [grant(['tag:web'], ['80']), grant(['tag:web'], ['443'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [(0, [0, 1])])
+
+    def test_partly_covered(self):
+        acls = [acl(['tag:web:80,443'])]
+        grants = [grant(['tag:web'], ['80'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [])
+
+    def test_grant_for_one_protocol_doesnt_cover_all(self):
+        acls = [acl(['tag:web:443'])]
+        grants = [grant(['tag:web'], ['tcp:443'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [])
+        acls = [acl(['tag:web:443'], proto='tcp')]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [(0, [0])])
+
+    def test_via_grants_dont_count(self):
+        acls = [acl(['tag:web:443'])]
+        grants = [grant(['tag:web'], ['443'], via=['tag:router'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [])
+
+    def test_posture_must_match(self):
+        grants = [grant(['tag:web'], ['443'], srcPosture=['posture:corp'])]
+        self.assertEqual(mapper.find_redundant_acls([acl(['tag:web:443'])], grants, GROUPS, HOSTS), [])
+        acls = [acl(['tag:web:443'], srcPosture=['posture:corp'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS), [(0, [0])])
+
+    def test_default_posture(self):
+        acls = [acl(['tag:web:443'])]
+        grants = [grant(['tag:web'], ['443'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS, ['posture:corp']), [(0, [0])])
+        grants = [grant(['tag:web'], ['443'], srcPosture=['posture:other'])]
+        self.assertEqual(mapper.find_redundant_acls(acls, grants, GROUPS, HOSTS, ['posture:corp']), [])
+
+
+class RemoveRulesFromTextTest(unittest.TestCase):
+    def test_removes_rule_lines(self):
+        text, kept = mapper.remove_rules_from_text(POLICY, 'acls', [0, 1])
+        self.assertEqual(kept, [])
+        self.assertNotIn('db:5432', text)
+        self.assertNotIn('tag:web', text)
+        self.assertIn('// Kept until the grants are rolled out', text)
+        self.assertIn('tag:ci:22', text)
+
+    def test_keeps_rules_sharing_a_line(self):
+        text, kept = mapper.remove_rules_from_text(POLICY, 'acls', [2])
+        self.assertEqual(kept, [2])
+        self.assertEqual(text, POLICY)
+
+
+class WriteWithoutRedundantAclsTest(unittest.TestCase):
+    def test_writes_policy(self):
+        sources = {'policy.hujson': POLICY, 'extra.hujson': '{"acls": [{}]}'}
+        provenance = {'acls': [('policy.hujson', 0), ('policy.hujson', 1), ('policy.hujson', 2),
+                               ('policy.hujson', 3), ('extra.hujson', 0)]}
+        with tempfile.TemporaryDirectory() as directory:
+            filename = os.path.join(directory, 'out.hujson')
+            with redirect_stdout(StringIO()) as output:
+                mapper.write_without_redundant_acls(filename, [(1, [0]), (4, [0])], 'policy.hujson', sources,
+                                                    provenance)
+            with open(filename) as f:
+                text = f.read()
+        self.assertNotIn('tag:web', text)
+        self.assertIn('db:5432', text)
+        self.assertIn("imported file 'extra.hujson'", output.getvalue())
+        self.assertIn("Removed 1 redundant ACL rule(s)", output.getvalue())
+        mapper.hjson.loads(text)
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,60 @@
+import unittest
+
+from mapper import mapper
+
+GROUPS = {'group:eng': ['alice@example.com']}
+HOSTS = {'db': '100.64.0.10', 'net': '100.64.0.0/24'}
+
+
+def acl(dst, **fields):
+    return dict({'action': 'accept', 'src': ['group:eng'], 'dst': dst}, **fields)
+
+
+def grant(dst, ip, **fields):
+    return dict({'src': ['group:eng'], 'dst': dst, 'ip': ip}, **fields)
+
+
+class RuleRemovalImpactTest(unittest.TestCase):
+    def test_lost_access(self):
+        lost, covered = mapper.rule_removal_impact([acl(['db:5432'])], 0, GROUPS, HOSTS)
+        self.assertEqual(lost, [('alice@example.com', '100.64.0.10', None, [(5432, 5432)])])
+        self.assertEqual(covered, [])
+
+    def test_covered_by_other_rule(self):
+        acls = [acl(['db:5432']), acl(['db:*'])]
+        lost, covered = mapper.rule_removal_impact(acls, 0, GROUPS, HOSTS)
+        self.assertEqual(lost, [])
+        self.assertEqual(covered, [('alice@example.com', '100.64.0.10', None, ['rule #1'])])
+
+    def test_covered_by_grant_to_network(self):
+        grants = [grant(['net'], ['tcp:5432'])]
+        lost, covered = mapper.rule_removal_impact([acl(['db:5432'], proto='tcp')], 0, GROUPS, HOSTS, grants)
+        self.assertEqual(lost, [])
+        self.assertEqual(covered, [('alice@example.com', '100.64.0.10', 6, ['grant #0'])])
+
+    def test_other_protocol_does_not_cover(self):
+        acls = [acl(['db:53'], proto='udp'), acl(['db:53'], proto='tcp')]
+        lost, covered = mapper.rule_removal_impact(acls, 0, GROUPS, HOSTS)
+        self.assertEqual(lost, [('alice@example.com', '100.64.0.10', 17, [(53, 53)])])
+        self.assertEqual(covered, [])
+
+    def test_rule_for_every_protocol_covers_one(self):
+        acls = [acl(['db:53'], proto='udp'), acl(['db:53'])]
+        lost, _ = mapper.rule_removal_impact(acls, 0, GROUPS, HOSTS)
+        self.assertEqual(lost, [])
+
+    def test_posture_must_be_met(self):
+        grants = [grant(['db'], ['*'], srcPosture=['posture:managed'])]
+        lost, _ = mapper.rule_removal_impact([acl(['db:22'])], 0, GROUPS, HOSTS, grants)
+        self.assertEqual(len(lost), 1)
+        lost, _ = mapper.rule_removal_impact([acl(['db:22'])], 0, GROUPS, HOSTS, grants, ['posture:managed'])
+        self.assertEqual(lost, [])
+
+    def test_via_grant_ignored(self):
+        grants = [grant(['db'], ['*'], via=['tag:router'])]
+        lost, _ = mapper.rule_removal_impact([acl(['db:22'])], 0, GROUPS, HOSTS, grants)
+        self.assertEqual(len(lost), 1)
+
+
+if __name__ == '__main__':
+    unittest.main()
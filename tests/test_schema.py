@@ -0,0 +1,58 @@
+import unittest
+
+from mapper import mapper
+
+
+def errors(policy):
+    return mapper.validate_schema(policy, mapper.POLICY_SCHEMA)
+
+
+class ValidateSchemaTest(unittest.TestCase):
+    def test_valid_policy(self):
+        policy = {
+            'groups': {'group:eng': ['alice@example.com']},
+            'hosts': {'db': '100.64.0.10', 'labs': '192.168.1.0/24, 192.168.2.0/24'},
+            'acls': [{'action': 'accept', 'src': ['group:eng'], 'dst': ['db:5432'], 'proto': ['tcp', 'udp']}],
+            'grants': [{'src': ['group:eng'], 'dst': ['db'], 'ip': ['tcp:443', '*']}],
+            'ssh': [{'action': 'check', 'src': ['group:eng'], 'dst': ['tag:web'], 'users': ['root']}],
+        }
+        self.assertEqual(errors(policy), [])
+
+    def test_unknown_properties(self):
+        policy = {'Hosts': {}, 'acls': [{'action': 'accept', 'src': ['*'], 'dts': ['*:*']}]}
+        self.assertEqual(errors(policy), [
+            ('/Hosts', "unknown property 'Hosts'"),
+            ('/acls/0', "missing required property 'dst'"),
+            ('/acls/0/dts', "unknown property 'dts'"),
+        ])
+
+    def test_grant_passes_unknown_fields_through(self):
+        policy = {'grants': [{'src': ['*'], 'dst': ['*'], 'ip': ['*'], 'newCondition': {'when': 'later'}}]}
+        self.assertEqual(errors(policy), [])
+
+    def test_grant_needs_ip_or_app(self):
+        self.assertEqual(errors({'grants': [{'src': ['*'], 'dst': ['*']}]}),
+                         [('/grants/0', "a grant needs an ip list or an app object")])
+
+    def test_patterns_and_types(self):
+        policy = {
+            'groups': {'eng': ['alice@example.com']},
+            'hosts': {'db': ['100.64.0.10']},
+            'acls': [{'action': 'allow', 'src': [], 'dst': ['db']}],
+            'grants': [{'src': ['*'], 'dst': ['*'], 'ip': ['443x']}],
+        }
+        found = errors(policy)
+        self.assertIn(('/groups/eng', "unknown property 'eng'"), found)
+        self.assertIn(('/hosts/db', "expected string, got array"), found)
+        self.assertIn(('/acls/0/action', '"allow" is not one of "accept"'), found)
+        self.assertIn(('/acls/0/src', "needs at least 1 item(s)"), found)
+        self.assertIn(('/acls/0/dst/0', '"db" does not match the pattern :[\\d,*-]+$'), found)
+        self.assertIn(('/grants/0/ip/0', '"443x" does not match the pattern ^(?:[\\w-]+:)?[\\d,*-]+$'), found)
+
+    def test_pointer_escapes_route_keys(self):
+        policy = {'autoApprovers': {'routes': {'10.0.0.0/8': 'tag:router'}}}
+        self.assertEqual(errors(policy), [('/autoApprovers/routes/10.0.0.0~18', "expected array, got string")])
+
+
+if __name__ == '__main__':
+    unittest.main()
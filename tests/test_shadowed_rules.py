@@ -0,0 +1,67 @@
+import unittest
+
+from mapper import mapper
+
+GROUPS = {'group:eng': ['alice@example.com', 'bob@example.com']}
+HOSTS = {'db': '100.64.0.10', 'net': '100.64.0.0/24'}
+
+
+def acl(src, dst, **fields):
+    return dict({'action': 'accept', 'src': src, 'dst': dst}, **fields)
+
+
+def grant(src, dst, ip, **fields):
+    return dict({'src': src, 'dst': dst, 'ip': ip}, **fields)
+
+
+def shadowed(acls=(), grants=()):
+    return mapper.find_shadowed_rules(list(acls), list(grants), GROUPS, HOSTS)
+
+
+class FindShadowedRulesTest(unittest.TestCase):
+    def test_duplicate(self):
+        self.assertEqual(shadowed([acl(['group:eng'], ['db:22']), acl(['group:eng'], ['db:22'])]),
+                         [('acls', 1, 0, True)])
+
+    def test_narrower_rule(self):
+        acls = [acl(['*'], ['net:*']), acl(['group:eng'], ['db:22,443'])]
+        self.assertEqual(shadowed(acls), [('acls', 1, 0, False)])
+
+    def test_group_member_covered_by_group(self):
+        acls = [acl(['group:eng'], ['db:*']), acl(['alice@example.com'], ['db:22'])]
+        self.assertEqual(shadowed(acls), [('acls', 1, 0, False)])
+
+    def test_later_broader_rule_is_not_shadowed(self):
+        self.assertEqual(shadowed([acl(['group:eng'], ['db:22']), acl(['group:eng'], ['db:*'])]), [])
+
+    def test_ports_split_across_rules_do_not_count(self):
+        acls = [acl(['group:eng'], ['db:22']), acl(['group:eng'], ['db:443']), acl(['group:eng'], ['db:22,443'])]
+        self.assertEqual(shadowed(acls), [])
+
+    def test_protocol(self):
+        self.assertEqual(shadowed([acl(['group:eng'], ['db:53'], proto='tcp'),
+                                   acl(['group:eng'], ['db:53'], proto='udp')]), [])
+        self.assertEqual(shadowed([acl(['group:eng'], ['db:53']), acl(['group:eng'], ['db:53'], proto='udp')]),
+                         [('acls', 1, 0, False)])
+
+    def test_posture(self):
+        acls = [acl(['group:eng'], ['db:22'], srcPosture=['posture:managed']), acl(['group:eng'], ['db:22'])]
+        self.assertEqual(shadowed(acls), [])
+        self.assertEqual(shadowed(list(reversed(acls))), [('acls', 1, 0, False)])
+
+    def test_grants(self):
+        grants = [grant(['group:eng'], ['net'], ['tcp:*']), grant(['group:eng'], ['db'], ['tcp:22'])]
+        self.assertEqual(shadowed(grants=grants), [('grants', 1, 0, False)])
+
+    def test_acls_and_grants_are_compared_separately(self):
+        self.assertEqual(shadowed([acl(['group:eng'], ['db:22'])], [grant(['group:eng'], ['db'], ['22'])]), [])
+
+    def test_via_and_app_grants_left_out(self):
+        grants = [grant(['group:eng'], ['db'], ['*']),
+                  grant(['group:eng'], ['db'], ['22'], via=['tag:router']),
+                  grant(['group:eng'], ['db'], ['22'], app={'example.com/cap/db': [{}]})]
+        self.assertEqual(shadowed(grants=grants), [])
+
+
+if __name__ == '__main__':
+    unittest.main()
@@ -0,0 +1,72 @@
+import unittest
+
+from mapper import mapper
+
+POLICY = """// Example {not a brace}
+{
+  "groups": {
+    "group:eng": ["alice@example.com"], /* } */
+  },
+  "acls": [
+    {"action": "accept", "src": ["group:eng"], "dst": ["tag:web:443"]}, {"action": "accept", "src": ["*"], "dst": ["tag:db:5432"]},
+    {
+      "action": "accept",
+      "src": ["tag:web"],
+      "dst": ["tag:db:5432"],
+    },
+  ],
+}
+"""
+
+
+class TokenizeHujsonTest(unittest.TestCase):
+    def test_skips_comments(self):
+        tokens = list(mapper.tokenize_hujson('{ // {\n "a": 1 /* [ */ }'))
+        self.assertEqual(tokens, [
+            ('punct', '{', 1, 1),
+            ('string', 'a', 2, 2),
+            ('punct', ':', 2, 5),
+            ('literal', '1', 2, 7),
+            ('punct', '}', 2, 17),
+        ])
+
+    def test_escaped_quotes(self):
+        tokens = list(mapper.tokenize_hujson('["a\\"b", "c"]'))
+        self.assertEqual([value for kind, value, _, _ in tokens if kind == 'string'], ['a\\"b', 'c'])
+
+    def test_multiline_block_comment_counts_lines(self):
+        tokens = list(mapper.tokenize_hujson('/*\n\n*/ {\n}'))
+        self.assertEqual(tokens, [('punct', '{', 3, 4), ('punct', '}', 4, 1)])
+
+
+class FindValuePositionsTest(unittest.TestCase):
+    def test_definitions_and_rules(self):
+        positions = mapper.find_value_positions(POLICY)
+        self.assertEqual(positions[('groups', 'group:eng')], (4, 18))
+        self.assertEqual(positions[('acls', 0)], (7, 5))
+        self.assertEqual(positions[('acls', 2)], (8, 5))
+
+    def test_rules_on_one_line(self):
+        positions = mapper.find_value_positions(POLICY)
+        self.assertEqual(positions[('acls', 1)][0], 7)
+        self.assertGreater(positions[('acls', 1)][1], positions[('acls', 0)][1])
+
+    def test_rule_lines(self):
+        self.assertEqual(mapper.find_rule_lines(POLICY, 'acls'), [(7, 7), (7, 7), (8, 12)])
+
+
+class FindDuplicateKeysTest(unittest.TestCase):
+    def test_no_duplicates(self):
+        self.assertEqual(mapper.find_duplicate_keys(POLICY), [])
+
+    def test_duplicate_key(self):
+        text = '{\n "groups": {\n  "group:a": [],\n  "group:a": ["x"]\n }\n}'
+        self.assertEqual(mapper.find_duplicate_keys(text), [('groups', 'group:a', 3, 4)])
+
+    def test_unquoted_keys(self):
+        text = '{\n hosts: {\n  a: "1.1.1.1"\n  b: "1.1.1.1"\n  a: "1.1.1.2"\n }\n}'
+        self.assertEqual(mapper.find_duplicate_keys(text), [('hosts', 'a', 3, 5)])
+
+
+if __name__ == '__main__':
+    unittest.main()